@@ -0,0 +1,461 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-pdf/fpdf"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// How photos are laid out on a page. Full bleed is one photo covering
+// the page, two-up is one or two and grid is up to four, all fitted
+// with their captions underneath.
+const (
+	BookFullBleed = "full-bleed"
+	BookTwoUp     = "two-up"
+	BookGrid      = "grid"
+)
+
+const (
+	// In millimeters.
+	bookMargin  = 15
+	bookGutter  = 6
+	bookCaption = 10
+
+	// In points.
+	bookTitleSize   = 32
+	bookSubtitle    = 14
+	bookCaptionSize = 9
+
+	bookFont = "go"
+)
+
+type BookOptions struct {
+	Album     string
+	Output    string
+	Paper     string
+	Landscape bool
+	Feature   int
+}
+
+// Books and the print sized photos in them are only for printing, so
+// they have to go somewhere that isn't published with the site.
+func (o *BookOptions) Check(albumsRoot string) error {
+	if _, ok := paperSizes[o.Paper]; !ok {
+		return fmt.Errorf("unknown paper '%s'", o.Paper)
+	}
+	if o.Output == "" {
+		return fmt.Errorf("books need an output directory outside the site")
+	}
+
+	site, err := siteRoot(albumsRoot)
+	if err != nil {
+		return err
+	}
+	output, err := filepath.Abs(o.Output)
+	if err != nil {
+		return err
+	}
+	if relative, err := filepath.Rel(site, output); err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("'%s' is inside the site at '%s', books would be published", o.Output, site)
+	}
+
+	return nil
+}
+
+type bookPage struct {
+	Template string
+	Files    []*AlbumFile
+}
+
+// A rectangle on the page, in millimeters.
+type bookFrame struct {
+	X, Y, W, H float64
+}
+
+// The largest dx by dy shaped rectangle in the middle of the frame.
+func (f bookFrame) Fit(dx, dy uint) bookFrame {
+	scale := min(f.W/float64(dx), f.H/float64(dy))
+	w, h := float64(dx)*scale, float64(dy)*scale
+	return bookFrame{X: f.X + (f.W-w)/2, Y: f.Y + (f.H-h)/2, W: w, H: h}
+}
+
+// The smallest dx by dy shaped rectangle that covers the frame.
+func (f bookFrame) Cover(dx, dy uint) bookFrame {
+	scale := max(f.W/float64(dx), f.H/float64(dy))
+	w, h := float64(dx)*scale, float64(dy)*scale
+	return bookFrame{X: f.X + (f.W-w)/2, Y: f.Y + (f.H-h)/2, W: w, H: h}
+}
+
+func (f bookFrame) Split(n int, across bool) []bookFrame {
+	frames := make([]bookFrame, 0, n)
+	for i := 0; i < n; i++ {
+		if across {
+			w := (f.W - bookGutter*float64(n-1)) / float64(n)
+			frames = append(frames, bookFrame{X: f.X + float64(i)*(w+bookGutter), Y: f.Y, W: w, H: f.H})
+		} else {
+			h := (f.H - bookGutter*float64(n-1)) / float64(n)
+			frames = append(frames, bookFrame{X: f.X, Y: f.Y + float64(i)*(h+bookGutter), W: f.W, H: h})
+		}
+	}
+	return frames
+}
+
+// Photos rated at least feature get a page to themselves, the rest
+// fill grids in album order, with a short run at the end or before a
+// featured photo going two-up.
+func planBook(files []*AlbumFile, feature int) []*bookPage {
+	pages := make([]*bookPage, 0)
+	pending := make([]*AlbumFile, 0)
+
+	flush := func() {
+		switch {
+		case len(pending) == 0:
+			return
+		case len(pending) <= 2:
+			pages = append(pages, &bookPage{Template: BookTwoUp, Files: pending})
+		default:
+			pages = append(pages, &bookPage{Template: BookGrid, Files: pending})
+		}
+		pending = make([]*AlbumFile, 0)
+	}
+
+	for _, af := range files {
+		if int(af.Xmp.Rdf.Description.Rating) >= feature {
+			flush()
+			pages = append(pages, &bookPage{Template: BookFullBleed, Files: []*AlbumFile{af}})
+			continue
+		}
+
+		pending = append(pending, af)
+		if len(pending) == 4 {
+			flush()
+		}
+	}
+
+	flush()
+
+	return pages
+}
+
+func bookCommand(args []string) {
+	o := &BookOptions{}
+	albumsRoot := ""
+
+	flags := flag.NewFlagSet("book", flag.ExitOnError)
+	flags.StringVar(&albumsRoot, "albums", "", "albums root directory")
+	flags.StringVar(&o.Album, "album", "", "only this album, by path")
+	flags.StringVar(&o.Output, "output", "", "directory for the books and their prints, outside the site")
+	flags.StringVar(&o.Paper, "paper", "a4", "a3, a4, a5, letter or legal")
+	flags.BoolVar(&o.Landscape, "landscape", false, "turn the paper sideways")
+	flags.IntVar(&o.Feature, "feature", 5, "photos rated at least this get a page of their own")
+
+	flags.Parse(args)
+
+	if albumsRoot == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	err := o.Check(albumsRoot)
+	if err != nil {
+		panic(err)
+	}
+
+	g, err := NewGenerator("config.json", albumsRoot, ReadMode)
+	if err != nil {
+		panic(err)
+	}
+
+	found := false
+	for _, album := range g.Cache.AllAlbums {
+		if o.Album != "" && album.Config.PathName != o.Album {
+			continue
+		}
+
+		found = true
+
+		err = g.Book(album, o)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if !found {
+		panic(fmt.Errorf("no album '%s'", o.Album))
+	}
+
+	err = g.Manifest.Save()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Makes the print derivative for a photo under root, the book only
+// ever places these.
+func (g *Generator) PrintDerivative(af *AlbumFile, root string) (*ImageMeta, error) {
+	meta := CalculateNewSizes(root, af.Original, g.Profile(ProfilePrint), ProfilePrint)
+
+	err := g.ResizePhoto(af.OriginalPath, meta, ProfilePrint)
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+type bookWriter struct {
+	g      *Generator
+	pdf    *fpdf.Fpdf
+	width  float64
+	height float64
+	prints map[*AlbumFile]*ImageMeta
+}
+
+// Lays out an album as a PDF of its print derivatives. Duplicates are
+// dropped first, as they are from the album's pages.
+func (g *Generator) Book(album *Album, o *BookOptions) error {
+	if g.Config.Duplicates != nil {
+		err := g.FindDuplicates(album)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(album.Files) == 0 {
+		return nil
+	}
+
+	pages := planBook(album.Files, o.Feature)
+
+	log.Printf("book '%s' (%d files, %d pages)", album.Config.Title, len(album.Files), len(pages)+1)
+
+	cover, err := g.ChooseCover(album)
+	if err != nil {
+		return err
+	}
+
+	size := paperSizes[o.Paper]
+	if o.Landscape {
+		size[0], size[1] = size[1], size[0]
+	}
+
+	pdf := fpdf.NewCustom(&fpdf.InitType{
+		UnitStr: "mm",
+		Size:    fpdf.SizeType{Wd: size[0], Ht: size[1]},
+	})
+	pdf.SetMargins(0, 0, 0)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.SetTitle(album.Config.Title, true)
+	pdf.AddUTF8FontFromBytes(bookFont, "", goregular.TTF)
+	pdf.AddUTF8FontFromBytes(bookFont, "B", gobold.TTF)
+
+	w := &bookWriter{
+		g:      g,
+		pdf:    pdf,
+		width:  size[0],
+		height: size[1],
+		prints: make(map[*AlbumFile]*ImageMeta),
+	}
+
+	for _, af := range album.Files {
+		w.prints[af], err = g.PrintDerivative(af, o.Output)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.CoverPage(album, cover)
+
+	for _, page := range pages {
+		err = w.Page(page)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(o.Output, 0755)
+	if err != nil {
+		return err
+	}
+
+	return pdf.OutputFileAndClose(filepath.Join(o.Output, fmt.Sprintf("%s.book.pdf", album.Config.PathName)))
+}
+
+func (w *bookWriter) content() bookFrame {
+	return bookFrame{X: bookMargin, Y: bookMargin, W: w.width - 2*bookMargin, H: w.height - 2*bookMargin}
+}
+
+func (w *bookWriter) image(af *AlbumFile, f bookFrame) {
+	w.pdf.ImageOptions(w.prints[af].Path, f.X, f.Y, f.W, f.H, false, fpdf.ImageOptions{ImageType: "JPG"}, 0, "")
+}
+
+// Shortens text to fit width millimeters in the current font.
+func (w *bookWriter) fit(text string, width float64) string {
+	fitted := text
+	for runes := []rune(text); w.pdf.GetStringWidth(fitted) > width && len(runes) > 0; {
+		runes = runes[:len(runes)-1]
+		fitted = string(runes) + "…"
+	}
+	return fitted
+}
+
+func (w *bookWriter) text(text string, x, y, width, height float64, align string) {
+	w.pdf.SetXY(x, y)
+	w.pdf.CellFormat(width, height, w.fit(text, width), "", 0, align, false, 0, "")
+}
+
+// Title and caption on the first line, the date on the second.
+func (w *bookWriter) captions(af *AlbumFile) (string, string, error) {
+	pm, err := w.g.PhotoMetadata(af.OriginalPath, []string{MetadataTitle, MetadataCaption})
+	if err != nil {
+		return "", "", err
+	}
+
+	first := pm.Title
+	switch {
+	case first == "":
+		first = pm.Caption
+	case pm.Caption != "":
+		first += " — " + pm.Caption
+	}
+
+	date := ""
+	if !af.CreatedAt.IsZero() {
+		date = af.CreatedAt.Format("2 January 2006")
+	}
+
+	if first == "" {
+		return date, "", nil
+	}
+
+	return first, date, nil
+}
+
+func (w *bookWriter) CoverPage(album *Album, cover *AlbumFile) {
+	w.pdf.AddPage()
+
+	content := w.content()
+	titleHeight := 20.0
+
+	w.pdf.SetTextColor(0, 0, 0)
+	w.pdf.SetFont(bookFont, "B", bookTitleSize)
+	w.text(album.Config.Title, content.X, content.Y, content.W, titleHeight, "CM")
+
+	w.pdf.SetFont(bookFont, "", bookSubtitle)
+	w.pdf.SetTextColor(96, 96, 96)
+	w.text(collageDate(album), content.X, content.Y+titleHeight, content.W, 10, "CM")
+
+	if cover != nil {
+		photo := bookFrame{X: content.X, Y: content.Y + titleHeight + 10 + bookGutter, W: content.W, H: content.H - titleHeight - 10 - bookGutter}
+		print := w.prints[cover]
+		w.image(cover, photo.Fit(print.Dx, print.Dy))
+	}
+}
+
+func (w *bookWriter) Page(page *bookPage) error {
+	w.pdf.AddPage()
+
+	if page.Template == BookFullBleed {
+		return w.FullBleed(page.Files[0])
+	}
+
+	content := w.content()
+
+	var frames []bookFrame
+	if page.Template == BookGrid {
+		for _, row := range content.Split(2, false) {
+			frames = append(frames, row.Split(2, true)...)
+		}
+	} else {
+		// Side by side or one above the other, whichever shows more
+		// of the photos.
+		area := func(frames []bookFrame) float64 {
+			total := 0.0
+			for i, af := range page.Files {
+				print := w.prints[af]
+				fitted := bookFrame{W: frames[i].W, H: frames[i].H - bookCaption}.Fit(print.Dx, print.Dy)
+				total += fitted.W * fitted.H
+			}
+			return total
+		}
+		frames = content.Split(len(page.Files), true)
+		if stacked := content.Split(len(page.Files), false); area(stacked) > area(frames) {
+			frames = stacked
+		}
+	}
+
+	for i, af := range page.Files {
+		err := w.Framed(af, frames[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A photo fitted in a frame, captioned underneath.
+func (w *bookWriter) Framed(af *AlbumFile, frame bookFrame) error {
+	print := w.prints[af]
+	photo := bookFrame{X: frame.X, Y: frame.Y, W: frame.W, H: frame.H - bookCaption}.Fit(print.Dx, print.Dy)
+	w.image(af, photo)
+
+	first, second, err := w.captions(af)
+	if err != nil {
+		return err
+	}
+
+	lineHeight := bookCaption / 2.0
+
+	w.pdf.SetFont(bookFont, "", bookCaptionSize)
+	w.pdf.SetTextColor(0, 0, 0)
+	w.text(first, photo.X, photo.Y+photo.H+1, photo.W, lineHeight, "LM")
+	w.pdf.SetTextColor(96, 96, 96)
+	w.text(second, photo.X, photo.Y+photo.H+1+lineHeight, photo.W, lineHeight, "LM")
+
+	return nil
+}
+
+// A photo covering the whole page, cropped around the middle, with
+// its captions on a band across the bottom.
+func (w *bookWriter) FullBleed(af *AlbumFile) error {
+	page := bookFrame{W: w.width, H: w.height}
+	print := w.prints[af]
+
+	w.pdf.ClipRect(page.X, page.Y, page.W, page.H, false)
+	w.image(af, page.Cover(print.Dx, print.Dy))
+	w.pdf.ClipEnd()
+
+	first, second, err := w.captions(af)
+	if err != nil {
+		return err
+	}
+
+	if first == "" {
+		return nil
+	}
+
+	band := bookFrame{X: 0, Y: w.height - bookMargin - bookCaption, W: w.width, H: bookCaption + bookMargin/2}
+
+	w.pdf.SetAlpha(0.6, "Normal")
+	w.pdf.SetFillColor(0, 0, 0)
+	w.pdf.Rect(band.X, band.Y, band.W, band.H, "F")
+	w.pdf.SetAlpha(1, "Normal")
+
+	lineHeight := bookCaption / 2.0
+
+	w.pdf.SetFont(bookFont, "", bookCaptionSize)
+	w.pdf.SetTextColor(255, 255, 255)
+	w.text(first, bookMargin, band.Y+bookMargin/4, band.W-2*bookMargin, lineHeight, "LM")
+	w.pdf.SetTextColor(208, 208, 208)
+	w.text(second, bookMargin, band.Y+bookMargin/4+lineHeight, band.W-2*bookMargin, lineHeight, "LM")
+
+	return nil
+}
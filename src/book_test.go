@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBookOptionsCheck(t *testing.T) {
+	site := t.TempDir()
+	albums := filepath.Join(site, "content", "albums")
+
+	tests := []struct {
+		name   string
+		paper  string
+		output string
+		err    string
+	}{
+		{"outside the site", "a4", filepath.Join(site, "print"), ""},
+		{"beside the site", "a4", filepath.Join(filepath.Dir(site), "books"), ""},
+		{"unknown paper", "a9", filepath.Join(site, "print"), "unknown paper"},
+		{"no output", "a4", "", "output directory"},
+		{"albums root", "a4", albums, "inside the site"},
+		{"under the albums", "a4", filepath.Join(albums, "print"), "inside the site"},
+		{"elsewhere in content", "a4", filepath.Join(site, "content", "books"), "inside the site"},
+		{"content itself", "a4", filepath.Join(site, "content"), "inside the site"},
+		{"looks like content", "a4", filepath.Join(site, "content-print"), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := &BookOptions{Paper: test.paper, Output: test.output}
+			err := o.Check(albums)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error about %s, got %v", test.err, err)
+			}
+		})
+	}
+}
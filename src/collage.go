@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// CollageConfig turns on a preview image per album, its best photos
+// side by side under the album's title, sized for link previews.
+type CollageConfig struct {
+	Photos int `json:"photos"`
+}
+
+const (
+	DefaultCollagePhotos = 4
+
+	collageWidth  = 1200
+	collageHeight = 630
+	collageGutter = 4
+
+	collageBand      = 110
+	collageMargin    = 32
+	collageTitleSize = 56
+	collageDateSize  = 28
+)
+
+// The album's cover first, then the best rated of the rest.
+func bestPhotos(album *Album, n int) []*AlbumFile {
+	files := append([]*AlbumFile{}, album.Files...)
+	sort.SliceStable(files, func(i, j int) bool {
+		if album.Cover != nil && (files[i].Name == album.Cover.Name) != (files[j].Name == album.Cover.Name) {
+			return files[i].Name == album.Cover.Name
+		}
+		return files[i].Xmp.Rdf.Description.Rating > files[j].Xmp.Rdf.Description.Rating
+	})
+	if len(files) > n {
+		files = files[:n]
+	}
+	return files
+}
+
+// Cells for n photos, one row for up to three and then two rows,
+// wider cells on the row with fewer photos.
+func collageCells(n int) []image.Rectangle {
+	rows := 1
+	if n > 3 {
+		rows = 2
+	}
+
+	cells := make([]image.Rectangle, 0, n)
+	for row := 0; row < rows; row++ {
+		columns := n / rows
+		if row < n%rows {
+			columns++
+		}
+		top := row * collageHeight / rows
+		bottom := (row + 1) * collageHeight / rows
+		for column := 0; column < columns; column++ {
+			left := column * collageWidth / columns
+			right := (column + 1) * collageWidth / columns
+			cells = append(cells, image.Rect(left, top, right, bottom).Inset(collageGutter/2))
+		}
+	}
+
+	return cells
+}
+
+// Images made from several photos are current while their settings
+// and all of their photos are unchanged. Returns the manifest source
+// and settings.
+func (g *Generator) compositeSettings(files []*AlbumFile, settings interface{}) (string, string, error) {
+	type photo struct {
+		Source   string        `json:"source"`
+		Size     int64         `json:"size"`
+		ModTime  string        `json:"mod_time"`
+		Override *CropOverride `json:"override,omitempty"`
+	}
+
+	composite := struct {
+		Settings interface{} `json:"settings"`
+		Photos   []photo     `json:"photos"`
+	}{
+		Settings: settings,
+	}
+
+	sources := make([]string, 0, len(files))
+	for _, af := range files {
+		info, err := os.Stat(af.OriginalPath)
+		if err != nil {
+			return "", "", err
+		}
+		composite.Photos = append(composite.Photos, photo{
+			Source:   af.OriginalPath,
+			Size:     info.Size(),
+			ModTime:  info.ModTime().String(),
+			Override: g.CropOverride(af.OriginalPath),
+		})
+		sources = append(sources, af.OriginalPath)
+	}
+
+	data, err := json.Marshal(composite)
+	if err != nil {
+		return "", "", err
+	}
+
+	return strings.Join(sources, ","), string(data), nil
+}
+
+func collageDate(album *Album) string {
+	if album.Date.IsZero() {
+		return ""
+	}
+	return album.Date.Format("January 2006")
+}
+
+// Draws the album's collage next to its gallery json, it's resized and
+// encoded like the social card.
+func (g *Generator) Collage(album *Album) error {
+	album.Collage = nil
+
+	photos := g.Config.Collage.Photos
+	if photos <= 0 {
+		photos = DefaultCollagePhotos
+	}
+
+	files := bestPhotos(album, photos)
+	if len(files) == 0 {
+		return nil
+	}
+
+	path := filepath.Join(g.AlbumsRoot, fmt.Sprintf("%s.collage.jpg", album.Config.PathName))
+
+	profile := g.Profile(ProfileSocial)
+
+	source, settings, err := g.compositeSettings(files, []string{album.Config.Title, collageDate(album), profile.Settings()})
+	if err != nil {
+		return err
+	}
+
+	meta := &ImageMeta{Path: path, Dx: collageWidth, Dy: collageHeight, Policy: FitFill}
+
+	if g.Manifest.Current(path, source, settings) {
+		album.Collage = meta
+		return nil
+	}
+
+	log.Printf("collage '%s' (%d photos)", album.Config.Title, len(files))
+
+	canvas := image.NewRGBA(image.Rect(0, 0, collageWidth, collageHeight))
+	draw.Draw(canvas, canvas.Bounds(), image.Black, image.Point{}, draw.Src)
+
+	for n, cell := range collageCells(len(files)) {
+		original, err := g.Cache.Load(files[n].OriginalPath)
+		if err != nil {
+			return err
+		}
+
+		crop, err := g.FillCrop(files[n].OriginalPath, original, cell.Dx(), cell.Dy())
+		if err != nil {
+			return err
+		}
+
+		resized := profile.Resize(original.(SubImager).SubImage(crop), uint(cell.Dx()), uint(cell.Dy()))
+
+		// Whatever the photos were, the collage is sRGB.
+		converted, _, _ := manageColor(resized, g.Cache.Images.Profile, ColorConvert)
+
+		draw.Draw(canvas, cell, converted, converted.Bounds().Min, draw.Src)
+	}
+
+	err = drawTitleBand(canvas, album.Config.Title, collageDate(album))
+	if err != nil {
+		return err
+	}
+
+	data, quality, err := profile.EncodeJpeg(canvas, 0)
+	if err != nil {
+		return err
+	}
+
+	err = g.SaveJpeg(data, path, nil)
+	if err != nil {
+		return err
+	}
+
+	g.Manifest.Record(path, &DerivativeRecord{
+		Source:   source,
+		Profile:  "collage",
+		Settings: settings,
+		Quality:  quality,
+		Bytes:    len(data),
+	})
+
+	album.Collage = meta
+
+	return nil
+}
+
+func openFace(ttf []byte, size float64) (font.Face, error) {
+	f, err := opentype.Parse(ttf)
+	if err != nil {
+		return nil, err
+	}
+	return opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    size,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+}
+
+// A translucent band across the bottom with the title on the left and
+// the date on the right, the title shortened if they don't both fit.
+func drawTitleBand(canvas *image.RGBA, title, date string) error {
+	bounds := canvas.Bounds()
+	band := image.Rect(bounds.Min.X, bounds.Max.Y-collageBand, bounds.Max.X, bounds.Max.Y)
+	draw.Draw(canvas, band, image.NewUniform(color.NRGBA{0, 0, 0, 160}), image.Point{}, draw.Over)
+
+	titleFace, err := openFace(gobold.TTF, collageTitleSize)
+	if err != nil {
+		return err
+	}
+	defer titleFace.Close()
+
+	dateFace, err := openFace(goregular.TTF, collageDateSize)
+	if err != nil {
+		return err
+	}
+	defer dateFace.Close()
+
+	baseline := fixed.I(band.Min.Y + (collageBand+titleFace.Metrics().Ascent.Ceil()-titleFace.Metrics().Descent.Ceil())/2)
+
+	right := fixed.I(band.Max.X - collageMargin)
+	if date != "" {
+		drawer := &font.Drawer{Dst: canvas, Src: image.NewUniform(color.NRGBA{220, 220, 220, 255}), Face: dateFace}
+		width := drawer.MeasureString(date)
+		drawer.Dot = fixed.Point26_6{X: right - width, Y: baseline}
+		drawer.DrawString(date)
+		right -= width + fixed.I(collageMargin)
+	}
+
+	drawer := &font.Drawer{Dst: canvas, Src: image.White, Face: titleFace}
+	available := right - fixed.I(band.Min.X+collageMargin)
+	text := title
+	for runes := []rune(title); drawer.MeasureString(text) > available && len(runes) > 0; {
+		runes = runes[:len(runes)-1]
+		text = strings.TrimSpace(string(runes)) + "…"
+	}
+
+	drawer.Dot = fixed.Point26_6{X: fixed.I(band.Min.X + collageMargin), Y: baseline}
+	drawer.DrawString(text)
+
+	return nil
+}
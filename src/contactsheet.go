@@ -0,0 +1,340 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// Paper sizes in millimeters, portrait.
+var paperSizes = map[string][2]float64{
+	"a3":     {297, 420},
+	"a4":     {210, 297},
+	"a5":     {148, 210},
+	"letter": {215.9, 279.4},
+	"legal":  {215.9, 355.6},
+}
+
+const (
+	millimetersPerInch = 25.4
+
+	// In points, so they come out the same size at any DPI.
+	contactMargin      = 36
+	contactPadding     = 6
+	contactHeaderSize  = 16
+	contactCaptionSize = 8
+	contactStarSize    = 8
+)
+
+type ContactSheetOptions struct {
+	Album     string
+	Output    string
+	Paper     string
+	Landscape bool
+	Dpi       int
+	Columns   int
+	Rows      int
+	Format    string
+}
+
+func (o *ContactSheetOptions) Check() error {
+	if _, ok := paperSizes[o.Paper]; !ok {
+		return fmt.Errorf("unknown paper '%s'", o.Paper)
+	}
+	if o.Dpi < 36 {
+		return fmt.Errorf("dpi should be at least 36")
+	}
+	if o.Columns < 1 || o.Rows < 1 {
+		return fmt.Errorf("the grid needs at least one column and row")
+	}
+	switch o.Format {
+	case "jpeg", "png":
+	default:
+		return fmt.Errorf("unknown format '%s'", o.Format)
+	}
+	return nil
+}
+
+// The page in pixels.
+func (o *ContactSheetOptions) Bounds() image.Rectangle {
+	size := paperSizes[o.Paper]
+	if o.Landscape {
+		size[0], size[1] = size[1], size[0]
+	}
+	dx := int(math.Round(size[0] / millimetersPerInch * float64(o.Dpi)))
+	dy := int(math.Round(size[1] / millimetersPerInch * float64(o.Dpi)))
+	return image.Rect(0, 0, dx, dy)
+}
+
+// Points to pixels.
+func (o *ContactSheetOptions) Pixels(points float64) int {
+	return int(math.Round(points * float64(o.Dpi) / 72))
+}
+
+func contactSheetCommand(args []string) {
+	o := &ContactSheetOptions{}
+	albumsRoot := ""
+
+	flags := flag.NewFlagSet("contact-sheet", flag.ExitOnError)
+	flags.StringVar(&albumsRoot, "albums", "", "albums root directory")
+	flags.StringVar(&o.Album, "album", "", "only this album, by path")
+	flags.StringVar(&o.Output, "output", "", "directory for the sheets, the albums root by default")
+	flags.StringVar(&o.Paper, "paper", "a4", "a3, a4, a5, letter or legal")
+	flags.BoolVar(&o.Landscape, "landscape", false, "turn the paper sideways")
+	flags.IntVar(&o.Dpi, "dpi", 150, "pixels per inch")
+	flags.IntVar(&o.Columns, "columns", 4, "photos across")
+	flags.IntVar(&o.Rows, "rows", 5, "photos down")
+	flags.StringVar(&o.Format, "format", "jpeg", "jpeg or png")
+
+	flags.Parse(args)
+
+	if albumsRoot == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	err := o.Check()
+	if err != nil {
+		panic(err)
+	}
+
+	if o.Output == "" {
+		o.Output = albumsRoot
+	}
+
+	g, err := NewGenerator("config.json", albumsRoot, ReadMode)
+	if err != nil {
+		panic(err)
+	}
+
+	found := false
+	for _, album := range g.Cache.AllAlbums {
+		if o.Album != "" && album.Config.PathName != o.Album {
+			continue
+		}
+
+		found = true
+
+		err = g.ContactSheets(album, o)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if !found {
+		panic(fmt.Errorf("no album '%s'", o.Album))
+	}
+
+	err = g.Manifest.Save()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Renders an album into as many sheets as it takes, from its
+// thumbnails, making any that are missing first. Duplicates are
+// dropped first, as they are from the album's pages.
+func (g *Generator) ContactSheets(album *Album, o *ContactSheetOptions) error {
+	if g.Config.Duplicates != nil {
+		err := g.FindDuplicates(album)
+		if err != nil {
+			return err
+		}
+	}
+
+	perSheet := o.Columns * o.Rows
+	sheets := (len(album.Files) + perSheet - 1) / perSheet
+
+	log.Printf("contact sheets '%s' (%d files, %d sheets)", album.Config.Title, len(album.Files), sheets)
+
+	for _, af := range album.Files {
+		err := g.Thumbnails(g.AlbumsRoot, af.OriginalPath, ThumbnailSizes)
+		if err != nil {
+			return err
+		}
+	}
+
+	headerFace, err := openFace(gobold.TTF, float64(o.Pixels(contactHeaderSize)))
+	if err != nil {
+		return err
+	}
+	defer headerFace.Close()
+
+	captionFace, err := openFace(goregular.TTF, float64(o.Pixels(contactCaptionSize)))
+	if err != nil {
+		return err
+	}
+	defer captionFace.Close()
+
+	for sheet := 0; sheet < sheets; sheet++ {
+		files := album.Files[sheet*perSheet:]
+		if len(files) > perSheet {
+			files = files[:perSheet]
+		}
+
+		page, err := g.ContactSheet(album, files, o, sheet, sheets, headerFace, captionFace)
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(o.Output, fmt.Sprintf("%s.contact-%02d.%s", album.Config.PathName, sheet+1, strings.Replace(o.Format, "jpeg", "jpg", 1)))
+
+		err = writeContactSheet(page, path, o.Format)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeContactSheet(page image.Image, path, format string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	if format == "png" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		return png.Encode(f, page)
+	}
+
+	data, err := encodeJpeg(page, DefaultMaxJpegQuality)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func (g *Generator) ContactSheet(album *Album, files []*AlbumFile, o *ContactSheetOptions, sheet, sheets int, headerFace, captionFace font.Face) (image.Image, error) {
+	bounds := o.Bounds()
+	page := image.NewRGBA(bounds)
+	draw.Draw(page, bounds, image.White, image.Point{}, draw.Src)
+
+	margin := o.Pixels(contactMargin)
+	padding := o.Pixels(contactPadding)
+	captionHeight := captionFace.Metrics().Height.Ceil()
+	headerHeight := headerFace.Metrics().Height.Ceil() + padding
+
+	header := &font.Drawer{Dst: page, Src: image.Black, Face: headerFace}
+	header.Dot = fixed.P(margin, margin+headerFace.Metrics().Ascent.Ceil())
+	header.DrawString(album.Config.Title)
+
+	numbering := fmt.Sprintf("%d / %d", sheet+1, sheets)
+	header.Dot = fixed.P(bounds.Max.X-margin-header.MeasureString(numbering).Ceil(), margin+headerFace.Metrics().Ascent.Ceil())
+	header.DrawString(numbering)
+
+	grid := image.Rect(margin, margin+headerHeight, bounds.Max.X-margin, bounds.Max.Y-margin)
+	cellWidth := grid.Dx() / o.Columns
+	cellHeight := grid.Dy() / o.Rows
+
+	// Square photos, as big as the cell allows under three lines of
+	// caption.
+	side := min(cellWidth-2*padding, cellHeight-2*padding-3*captionHeight)
+	if side < 1 {
+		return nil, fmt.Errorf("the grid is too fine for %s at %d dpi", o.Paper, o.Dpi)
+	}
+
+	resizer := (&ProfileConfig{Filter: DefaultResamplingFilter}).Resizer()
+	gray := image.NewUniform(color.Gray{96})
+
+	for n, af := range files {
+		cell := image.Rect(0, 0, cellWidth, cellHeight).Add(grid.Min).Add(image.Pt(n%o.Columns*cellWidth, n/o.Columns*cellHeight))
+
+		thumbnail, err := g.Cache.Load(ThumbnailPath(g.AlbumsRoot, af.OriginalPath, ThumbnailSizes[0]))
+		if err != nil {
+			return nil, err
+		}
+
+		photo := image.Rect(0, 0, side, side).Add(image.Pt(cell.Min.X+(cellWidth-side)/2, cell.Min.Y+padding))
+		resized := resizer.Resize(thumbnail, uint(side), uint(side))
+		draw.Draw(page, photo, resized, resized.Bounds().Min, draw.Src)
+
+		caption := &font.Drawer{Dst: page, Src: image.Black, Face: captionFace}
+		lineTop := photo.Max.Y + padding/2
+
+		caption.Dot = fixed.P(photo.Min.X, lineTop+captionFace.Metrics().Ascent.Ceil())
+		caption.DrawString(fitText(caption, af.Name, side))
+
+		if !af.CreatedAt.IsZero() {
+			caption.Src = gray
+			caption.Dot = fixed.P(photo.Min.X, lineTop+captionHeight+captionFace.Metrics().Ascent.Ceil())
+			caption.DrawString(fitText(caption, af.CreatedAt.Format("2006-01-02 15:04"), side))
+		}
+
+		drawRating(page, image.Pt(photo.Min.X, lineTop+2*captionHeight), o.Pixels(contactStarSize), int(af.Xmp.Rdf.Description.Rating))
+	}
+
+	return page, nil
+}
+
+// Shortens text to fit width pixels, marking where it was cut.
+func fitText(drawer *font.Drawer, text string, width int) string {
+	fitted := text
+	for runes := []rune(text); drawer.MeasureString(fitted).Ceil() > width && len(runes) > 0; {
+		runes = runes[:len(runes)-1]
+		fitted = string(runes) + "…"
+	}
+	return fitted
+}
+
+// Five stars, filled for the rating. The bundled fonts don't have
+// stars so they're drawn.
+func drawRating(page *image.RGBA, at image.Point, size, rating int) {
+	if rating < 0 {
+		return
+	}
+
+	filled := image.NewUniform(color.Gray{32})
+	empty := image.NewUniform(color.Gray{208})
+
+	for star := 0; star < 5; star++ {
+		r := vector.NewRasterizer(size, size)
+		outer, inner := float64(size)/2, float64(size)/5
+		for point := 0; point < 10; point++ {
+			radius := outer
+			if point%2 == 1 {
+				radius = inner
+			}
+			angle := -math.Pi/2 + float64(point)*math.Pi/5
+			x := float32(outer + radius*math.Cos(angle))
+			y := float32(outer + radius*math.Sin(angle))
+			if point == 0 {
+				r.MoveTo(x, y)
+			} else {
+				r.LineTo(x, y)
+			}
+		}
+		r.ClosePath()
+
+		src := empty
+		if star < rating {
+			src = filled
+		}
+
+		target := image.Rect(0, 0, size, size).Add(at).Add(image.Pt(star*(size+size/4), 0))
+		r.Draw(page, target, src, image.Point{})
+	}
+}
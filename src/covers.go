@@ -0,0 +1,187 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"log"
+	"math"
+	"os"
+
+	"github.com/muesli/smartcrop"
+	"github.com/muesli/smartcrop/nfnt"
+)
+
+// AlbumCover is the photo that represents an album in listings, and
+// its wide crop for social cards.
+type AlbumCover struct {
+	Name   string
+	Cover  *ImageMeta
+	Social *ImageMeta
+}
+
+const coverScoreSize = 256
+
+// Picks the configured cover, or the highest rated photo with the
+// most going on in its best crop.
+func (g *Generator) ChooseCover(album *Album) (*AlbumFile, error) {
+	if len(album.Files) == 0 {
+		return nil, nil
+	}
+
+	if name := album.Config.Cover; name != "" {
+		for _, af := range album.Files {
+			if af.Name == name || removeAllExtensions(af.Name) == removeAllExtensions(name) {
+				return af, nil
+			}
+		}
+		log.Printf("cover '%s' isn't in '%s', choosing one", name, album.Config.Title)
+	}
+
+	best := make([]*AlbumFile, 0)
+	for _, af := range album.Files {
+		rating := af.Xmp.Rdf.Description.Rating
+		switch {
+		case len(best) == 0 || rating > best[0].Xmp.Rdf.Description.Rating:
+			best = []*AlbumFile{af}
+		case rating == best[0].Xmp.Rdf.Description.Rating:
+			best = append(best, af)
+		}
+	}
+
+	if len(best) == 1 {
+		return best[0], nil
+	}
+
+	var chosen *AlbumFile
+	chosenScore := math.Inf(-1)
+	for _, af := range best {
+		score, err := g.CoverScore(af.OriginalPath)
+		if err != nil {
+			return nil, err
+		}
+		if score > chosenScore {
+			chosen, chosenScore = af, score
+		}
+	}
+
+	return chosen, nil
+}
+
+// Scores remembered in the manifest per source, like placeholders.
+func (g *Generator) CoverScore(source string) (float64, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return 0, err
+	}
+
+	record := g.Manifest.Source(source, info)
+	if record.CoverScore != nil {
+		return *record.CoverScore, nil
+	}
+
+	i, err := g.Cache.Load(source)
+	if err != nil {
+		return 0, err
+	}
+
+	score, err := coverScore(i)
+	if err != nil {
+		return 0, err
+	}
+
+	record.CoverScore = &score
+
+	return score, nil
+}
+
+// How much detail and color there is in smartcrop's choice of a social
+// card crop, measured like smartcrop does on a small copy.
+func coverScore(i image.Image) (float64, error) {
+	profile := &ProfileConfig{Width: coverScoreSize, Height: coverScoreSize, Fit: FitFit, Filter: "bilinear"}
+	width, height := profile.Dimensions(uint(i.Bounds().Dx()), uint(i.Bounds().Dy()))
+	small := toRGBA(profile.Resizer().Resize(i, width, height))
+
+	social := DefaultProfileSizes[ProfileSocial]
+	analyzer := smartcrop.NewAnalyzer(nfnt.NewDefaultResizer())
+	crop, err := analyzer.FindBestCrop(small, int(social[0]), int(social[1]))
+	if err != nil {
+		return 0, err
+	}
+
+	crop = crop.Intersect(small.Bounds())
+	if crop.Dx() < 3 || crop.Dy() < 3 {
+		return 0, nil
+	}
+
+	score := 0.0
+	for y := crop.Min.Y + 1; y < crop.Max.Y-1; y++ {
+		for x := crop.Min.X + 1; x < crop.Max.X-1; x++ {
+			score += interest(small, x, y)
+		}
+	}
+
+	return score / float64((crop.Dx()-2)*(crop.Dy()-2)), nil
+}
+
+// How much a pixel has going on, its edge strength plus a little of
+// its saturation. The pixel can't be on the image's edge.
+func interest(small *image.RGBA, x, y int) float64 {
+	luma := func(x, y int) float64 {
+		p := small.PixOffset(x, y)
+		return 0.2126*float64(small.Pix[p]) + 0.7152*float64(small.Pix[p+1]) + 0.0722*float64(small.Pix[p+2])
+	}
+
+	detail := math.Abs(4*luma(x, y)-luma(x-1, y)-luma(x+1, y)-luma(x, y-1)-luma(x, y+1)) / 255
+
+	saturation := 0.0
+	p := small.PixOffset(x, y)
+	r, g, b := float64(small.Pix[p]), float64(small.Pix[p+1]), float64(small.Pix[p+2])
+	maximum, minimum := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+	if maximum > 0 {
+		saturation = (maximum - minimum) / maximum
+	}
+
+	return detail + 0.2*saturation
+}
+
+func toRGBA(i image.Image) *image.RGBA {
+	if rgba, ok := i.(*image.RGBA); ok {
+		return rgba
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, i.Bounds().Dx(), i.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Bounds(), i, i.Bounds().Min, draw.Src)
+	return rgba
+}
+
+// Chooses the cover and makes its derivatives, leaving it on the album.
+func (g *Generator) Cover(album *Album) error {
+	af, err := g.ChooseCover(album)
+	if err != nil {
+		return err
+	}
+
+	if af == nil {
+		album.Cover = nil
+		return nil
+	}
+
+	cover := &AlbumCover{
+		Name:   af.Name,
+		Cover:  CalculateNewSizes(g.AlbumsRoot, af.Original, g.Profile(ProfileCover), "cover"),
+		Social: CalculateNewSizes(g.AlbumsRoot, af.Original, g.Profile(ProfileSocial), "social"),
+	}
+
+	err = g.ResizePhoto(af.OriginalPath, cover.Cover, ProfileCover)
+	if err != nil {
+		return err
+	}
+
+	err = g.ResizePhoto(af.OriginalPath, cover.Social, ProfileSocial)
+	if err != nil {
+		return err
+	}
+
+	album.Cover = cover
+
+	return nil
+}
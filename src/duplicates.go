@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math/bits"
+	"os"
+	"strconv"
+)
+
+// DuplicatesConfig turns on near-duplicate detection. Threshold is the
+// most bits two hashes can differ by and still be the same picture.
+// With KeepBest only the highest rated photo of each cluster stays in
+// the album.
+type DuplicatesConfig struct {
+	Threshold int  `json:"threshold"`
+	KeepBest  bool `json:"keep_best"`
+}
+
+const DefaultDuplicateThreshold = 10
+
+type DuplicateCluster struct {
+	Album string   `json:"album"`
+	Files []string `json:"files"`
+	Kept  string   `json:"kept,omitempty"`
+}
+
+// A 64 bit difference hash, each bit says whether a pixel of a 9x8
+// grayscale copy is brighter than its neighbour. It survives
+// resizing, recompression and small edits.
+func differenceHash(i image.Image) uint64 {
+	small := (&ProfileConfig{Filter: "bilinear"}).Resizer().Resize(i, 9, 8)
+
+	gray := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.Draw(gray, gray.Bounds(), small, small.Bounds().Min, draw.Src)
+
+	hash := uint64(0)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if gray.GrayAt(x, y).Y < gray.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+// Hashes are remembered in the manifest per source, like placeholders.
+func (g *Generator) DifferenceHash(source string) (uint64, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return 0, err
+	}
+
+	record := g.Manifest.Source(source, info)
+	if record.DHash != "" {
+		return strconv.ParseUint(record.DHash, 16, 64)
+	}
+
+	i, err := g.Cache.Load(source)
+	if err != nil {
+		return 0, err
+	}
+
+	hash := differenceHash(i)
+
+	record.DHash = fmt.Sprintf("%016x", hash)
+
+	return hash, nil
+}
+
+// Groups hashes that are all within the threshold of each other, in
+// order. Every hash joins the first group it's near all of, rather
+// than any one member of, so a run of small changes can't chain very
+// different photos together. Returns the indices of each group.
+func clusterHashes(hashes []uint64, threshold int) [][]int {
+	clusters := make([][]int, 0)
+
+	for i, hash := range hashes {
+		joined := false
+		for c, members := range clusters {
+			near := true
+			for _, j := range members {
+				if bits.OnesCount64(hash^hashes[j]) > threshold {
+					near = false
+					break
+				}
+			}
+			if near {
+				clusters[c] = append(members, i)
+				joined = true
+				break
+			}
+		}
+		if !joined {
+			clusters = append(clusters, []int{i})
+		}
+	}
+
+	return clusters
+}
+
+// Groups an album's photos whose hashes are within the threshold of
+// each other, reports every group and optionally keeps only the best
+// rated photo of each.
+func (g *Generator) FindDuplicates(album *Album) error {
+	cfg := g.Config.Duplicates
+
+	threshold := cfg.Threshold
+	if threshold == 0 {
+		threshold = DefaultDuplicateThreshold
+	}
+
+	hashes := make([]uint64, len(album.Files))
+	for i, af := range album.Files {
+		hash, err := g.DifferenceHash(af.OriginalPath)
+		if err != nil {
+			return err
+		}
+		hashes[i] = hash
+	}
+
+	clusters := clusterHashes(hashes, threshold)
+
+	dropped := make(map[int]bool)
+
+	for _, members := range clusters {
+		if len(members) < 2 {
+			continue
+		}
+
+		// Highest rating wins, the first one we came across breaks ties.
+		best := members[0]
+		for _, i := range members[1:] {
+			if album.Files[i].Xmp.Rdf.Description.Rating > album.Files[best].Xmp.Rdf.Description.Rating {
+				best = i
+			}
+		}
+
+		cluster := &DuplicateCluster{
+			Album: album.Config.PathName,
+		}
+		for _, i := range members {
+			cluster.Files = append(cluster.Files, album.Files[i].OriginalPath)
+		}
+
+		if cfg.KeepBest {
+			cluster.Kept = album.Files[best].OriginalPath
+			for _, i := range members {
+				if i != best {
+					dropped[i] = true
+				}
+			}
+		}
+
+		g.Report.Duplicates = append(g.Report.Duplicates, cluster)
+	}
+
+	if len(dropped) > 0 {
+		kept := make([]*AlbumFile, 0, len(album.Files)-len(dropped))
+		for i, af := range album.Files {
+			if dropped[i] {
+				g.Report.Exclude(album.Config.PathName, "duplicate")
+				continue
+			}
+			kept = append(kept, af)
+		}
+		album.Files = kept
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math/bits"
+	"reflect"
+	"testing"
+)
+
+func TestClusterHashes(t *testing.T) {
+	tests := []struct {
+		name      string
+		hashes    []uint64
+		threshold int
+		expected  [][]int
+	}{
+		{"empty", []uint64{}, 10, [][]int{}},
+		{"all different", []uint64{0x0, 0xffff, 0xffff0000}, 4, [][]int{{0}, {1}, {2}}},
+		{"identical", []uint64{0xabcd, 0xabcd, 0x0}, 0, [][]int{{0, 1}, {2}}},
+		{"within threshold", []uint64{0x0, 0x7, 0xf}, 4, [][]int{{0, 1, 2}}},
+		// 0x0 and 0xf differ by 4, as do 0xff00 and 0xf00, the pairs by 8 or more.
+		{"separate groups", []uint64{0x0, 0xff00, 0xf, 0xf00}, 4, [][]int{{0, 2}, {1, 3}}},
+		// Each is 4 bits from the next but the ends are 8 apart, so
+		// they mustn't end up together.
+		{"no chaining", []uint64{0x0, 0xf, 0xff}, 4, [][]int{{0, 1}, {2}}},
+		{"chain middle joins first", []uint64{0x0, 0xff, 0xf}, 4, [][]int{{0, 2}, {1}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clusters := clusterHashes(test.hashes, test.threshold)
+			if !reflect.DeepEqual(clusters, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, clusters)
+			}
+			for _, members := range clusters {
+				for _, i := range members {
+					for _, j := range members {
+						if d := bits.OnesCount64(test.hashes[i] ^ test.hashes[j]); d > test.threshold {
+							t.Fatalf("%d and %d are %d bits apart", i, j, d)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func gradientImage(width, height int, reverse bool) image.Image {
+	i := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := x * 255 / width
+			if reverse {
+				v = 255 - v
+			}
+			i.SetGray(x, y, color.Gray{Y: uint8(v)})
+		}
+	}
+	return i
+}
+
+func TestDifferenceHash(t *testing.T) {
+	brighter := differenceHash(gradientImage(900, 800, false))
+	if brighter != ^uint64(0) {
+		t.Fatalf("expected every bit set brightening to the right, got %016x", brighter)
+	}
+
+	darker := differenceHash(gradientImage(900, 800, true))
+	if darker != 0 {
+		t.Fatalf("expected no bits set darkening to the right, got %016x", darker)
+	}
+
+	resized := differenceHash(gradientImage(90, 80, false))
+	if d := bits.OnesCount64(brighter ^ resized); d > 2 {
+		t.Fatalf("resizing moved the hash %d bits", d)
+	}
+}
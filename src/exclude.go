@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Returns the exclusion tag that keeps this photo off the site, if
+// any. Excluding a tag also excludes everything below it, so private
+// covers private|family too.
+func (g *Generator) ExcludedByTag(xmp *XmpFile) string {
+	for _, excluded := range g.Config.ExcludeTags {
+		for _, tag := range xmp.Rdf.Description.HierarchicalSubjects.Subjects {
+			if tag == excluded || strings.HasPrefix(tag, excluded+"|") {
+				return excluded
+			}
+		}
+	}
+	return ""
+}
+
+// Bad patterns would otherwise quietly exclude nothing.
+func (ac *AlbumConfig) CheckExclude() error {
+	for _, pattern := range ac.Exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("album '%s': bad exclude pattern '%s'", ac.Title, pattern)
+		}
+	}
+	return nil
+}
+
+// Returns the first exclude pattern matching the file, patterns are
+// matched against the file name with and without its extensions.
+func (ac *AlbumConfig) ExcludedFile(name string) string {
+	base := filepath.Base(name)
+	for _, pattern := range ac.Exclude {
+		for _, candidate := range []string{base, removeAllExtensions(base)} {
+			if matched, err := filepath.Match(pattern, candidate); err == nil && matched {
+				return pattern
+			}
+		}
+	}
+	return ""
+}
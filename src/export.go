@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	texttemplate "text/template"
+)
+
+// ExportConfig describes an external command that turns a raw and its
+// side car into an exported image. Each argument is a template, for
+// example:
+//
+//	["darktable-cli", "{{.Raw}}", "{{.Xmp}}", "{{.Destination}}"]
+type ExportConfig struct {
+	Command     []string `json:"command"`
+	Output      string   `json:"output"`
+	Extension   string   `json:"extension"`
+	Concurrency int      `json:"concurrency"`
+}
+
+type ExportRun struct {
+	RawPath     string        `json:"raw"`
+	XmpPath     string        `json:"xmp"`
+	Destination string        `json:"destination"`
+	Command     []string      `json:"command"`
+	ExitStatus  int           `json:"exit_status"`
+	Output      string        `json:"output"`
+	Error       string        `json:"error,omitempty"`
+	Duration    time.Duration `json:"duration"`
+}
+
+type exportArguments struct {
+	Raw         string
+	Xmp         string
+	Name        string
+	Destination string
+}
+
+func (cfg *ExportConfig) commandFor(m *MissingExport) ([]string, string, error) {
+	extension := cfg.Extension
+	if extension == "" {
+		extension = ".jpg"
+	}
+
+	rawName := filepath.Base(m.RawPath)
+	name := strings.TrimSuffix(rawName, filepath.Ext(rawName))
+
+	args := exportArguments{
+		Raw:         m.RawPath,
+		Xmp:         m.XmpPath,
+		Name:        name,
+		Destination: filepath.Join(cfg.Output, name+extension),
+	}
+
+	command := make([]string, 0, len(cfg.Command))
+	for _, arg := range cfg.Command {
+		template, err := texttemplate.New("export").Parse(arg)
+		if err != nil {
+			return nil, "", err
+		}
+
+		buffer := &bytes.Buffer{}
+		err = template.Execute(buffer, args)
+		if err != nil {
+			return nil, "", err
+		}
+
+		command = append(command, buffer.String())
+	}
+
+	return command, args.Destination, nil
+}
+
+func runExport(run *ExportRun) {
+	started := time.Now()
+
+	cmd := exec.Command(run.Command[0], run.Command[1:]...)
+	output, err := cmd.CombinedOutput()
+
+	run.Duration = time.Since(started)
+	run.Output = string(output)
+
+	if err != nil {
+		run.ExitStatus = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			run.ExitStatus = exitErr.ExitCode()
+		}
+		run.Error = err.Error()
+		return
+	}
+
+	if _, err := os.Stat(run.Destination); err != nil {
+		run.Error = fmt.Sprintf("command succeeded with no export: %v", err)
+	}
+}
+
+// Plans the exports for the missing images. Destinations that exist
+// already, from an earlier run that left them outside the sources,
+// are returned to include rather than exported again.
+func (cfg *ExportConfig) Plan(missing []*MissingExport) ([]*ExportRun, []string, error) {
+	runs := make([]*ExportRun, 0, len(missing))
+	existing := make([]string, 0)
+
+	for _, m := range missing {
+		command, destination, err := cfg.commandFor(m)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if _, err := os.Stat(destination); err == nil {
+			existing = append(existing, destination)
+			continue
+		}
+
+		runs = append(runs, &ExportRun{
+			RawPath:     m.RawPath,
+			XmpPath:     m.XmpPath,
+			Destination: destination,
+			Command:     command,
+		})
+	}
+
+	return runs, existing, nil
+}
+
+// Runs the exports, as many at once as configured.
+func (cfg *ExportConfig) Run(runs []*ExportRun) error {
+	if len(runs) == 0 {
+		return nil
+	}
+
+	err := os.MkdirAll(cfg.Output, 0755)
+	if err != nil {
+		return err
+	}
+
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	log.Printf("exporting %d missing images (%d at a time)", len(runs), concurrency)
+
+	semaphore := make(chan bool, concurrency)
+	wg := sync.WaitGroup{}
+
+	for _, run := range runs {
+		wg.Add(1)
+		semaphore <- true
+		go func(run *ExportRun) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			runExport(run)
+		}(run)
+	}
+
+	wg.Wait()
+
+	return nil
+}
+
+func (cfg *ExportConfig) Check() error {
+	if len(cfg.Command) == 0 {
+		return fmt.Errorf("export command is required")
+	}
+	if cfg.Output == "" {
+		return fmt.Errorf("export output is required")
+	}
+	return nil
+}
+
+func (g *Generator) ExportMissing() error {
+	cfg := g.Config.Export
+
+	missing, err := g.FindMissing()
+	if err != nil {
+		return err
+	}
+
+	runs, existing, err := cfg.Plan(missing)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range existing {
+		err = g.IncludeImage(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = cfg.Run(runs)
+	if err != nil {
+		return err
+	}
+
+	g.Report.Exports = append(g.Report.Exports, runs...)
+
+	for _, run := range runs {
+		if run.Error != "" {
+			continue
+		}
+
+		err = g.IncludeImage(run.Destination)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
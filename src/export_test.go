@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeStub(t *testing.T, dir, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, "export.sh")
+	err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExportRunsOnceAndRecordsOutput(t *testing.T) {
+	dir := t.TempDir()
+	stub := writeStub(t, dir, "echo exporting \"$1\"\nprintf jpeg > \"$2\"\n")
+
+	cfg := &ExportConfig{
+		Command:     []string{"sh", stub, "{{.Raw}}", "{{.Destination}}"},
+		Output:      filepath.Join(dir, "exported"),
+		Concurrency: 1,
+	}
+	missing := []*MissingExport{{RawPath: "/raws/DSC001.ARW", XmpPath: "/raws/DSC001.ARW.xmp"}}
+
+	runs, existing, err := cfg.Plan(missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || len(existing) != 0 {
+		t.Fatalf("expected one run, got %d runs and %d existing", len(runs), len(existing))
+	}
+
+	err = cfg.Run(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := runs[0]
+	if run.ExitStatus != 0 || run.Error != "" {
+		t.Fatalf("expected success, got %d: %s", run.ExitStatus, run.Error)
+	}
+	if strings.TrimSpace(run.Output) != "exporting /raws/DSC001.ARW" {
+		t.Fatalf("unexpected output %q", run.Output)
+	}
+	if run.Destination != filepath.Join(dir, "exported", "DSC001.jpg") {
+		t.Fatalf("unexpected destination %s", run.Destination)
+	}
+
+	runs, existing, err = cfg.Plan(missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 0 || len(existing) != 1 || existing[0] != run.Destination {
+		t.Fatalf("expected the export to be reused, got %d runs and %v", len(runs), existing)
+	}
+}
+
+func TestExportRecordsFailures(t *testing.T) {
+	dir := t.TempDir()
+	stub := writeStub(t, dir, "echo broken >&2\nexit 3\n")
+
+	cfg := &ExportConfig{
+		Command: []string{"sh", stub, "{{.Raw}}", "{{.Destination}}"},
+		Output:  dir,
+	}
+
+	runs, _, err := cfg.Plan([]*MissingExport{{RawPath: "/raws/DSC002.ARW"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cfg.Run(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if runs[0].ExitStatus != 3 || runs[0].Error == "" || strings.TrimSpace(runs[0].Output) != "broken" {
+		t.Fatalf("unexpected run %+v", runs[0])
+	}
+	if _, err := os.Stat(runs[0].Destination); err == nil {
+		t.Fatalf("failed export left %s", runs[0].Destination)
+	}
+}
+
+func TestExportConfigCheck(t *testing.T) {
+	for _, cfg := range []*ExportConfig{
+		{Output: "/exported"},
+		{Command: []string{"darktable-cli"}},
+	} {
+		if cfg.Check() == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"log"
+	"math"
+	"path/filepath"
+
+	_ "embed"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// The frontal face cascade that comes with pigo, see cascade/LICENSE.
+//
+//go:embed cascade/facefinder
+var facefinderCascade []byte
+
+// FacesConfig turns on face detection for thumbnail crops. Debug is a
+// directory to write each photo with its faces and crops drawn on.
+type FacesConfig struct {
+	Cascade   string  `json:"cascade"`
+	MinSize   int     `json:"min_size"`
+	Threshold float32 `json:"threshold"`
+	Debug     string  `json:"debug"`
+}
+
+const (
+	DefaultFaceMinSize   = 20
+	DefaultFaceThreshold = 5
+
+	// Detection runs on a smaller copy, faces are big enough to find
+	// at this size and it's a lot faster.
+	faceDetectionSize = 800
+)
+
+type FaceDetector struct {
+	Config     *FacesConfig
+	classifier *pigo.Pigo
+}
+
+func NewFaceDetector(cfg *FacesConfig) (*FaceDetector, error) {
+	cascade := facefinderCascade
+	if cfg.Cascade != "" {
+		data, err := ioutil.ReadFile(cfg.Cascade)
+		if err != nil {
+			return nil, err
+		}
+		cascade = data
+	}
+
+	classifier, err := pigo.NewPigo().Unpack(cascade)
+	if err != nil {
+		return nil, fmt.Errorf("face cascade: %v", err)
+	}
+
+	return &FaceDetector{
+		Config:     cfg,
+		classifier: classifier,
+	}, nil
+}
+
+// Returns the faces in an image, in the image's coordinates.
+func (fd *FaceDetector) Detect(i image.Image) []image.Rectangle {
+	bounds := i.Bounds()
+
+	scale := math.Min(1, float64(faceDetectionSize)/float64(max(bounds.Dx(), bounds.Dy())))
+	width := int(float64(bounds.Dx()) * scale)
+	height := int(float64(bounds.Dy()) * scale)
+
+	small := i
+	if scale < 1 {
+		small = fd.resize(i, uint(width), uint(height))
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, width, height))
+	draw.Draw(gray, gray.Bounds(), small, small.Bounds().Min, draw.Src)
+
+	minSize := fd.Config.MinSize
+	if minSize == 0 {
+		minSize = DefaultFaceMinSize
+	}
+
+	threshold := fd.Config.Threshold
+	if threshold == 0 {
+		threshold = DefaultFaceThreshold
+	}
+
+	params := pigo.CascadeParams{
+		MinSize:     minSize,
+		MaxSize:     min(width, height),
+		ShiftFactor: 0.1,
+		ScaleFactor: 1.1,
+		ImageParams: pigo.ImageParams{
+			Pixels: gray.Pix,
+			Rows:   height,
+			Cols:   width,
+			Dim:    gray.Stride,
+		},
+	}
+
+	detections := fd.classifier.ClusterDetections(fd.classifier.RunCascade(params, 0), 0.2)
+
+	faces := make([]image.Rectangle, 0)
+	for _, d := range detections {
+		if d.Q < threshold {
+			continue
+		}
+		half := float64(d.Scale) / 2
+		face := image.Rect(
+			int((float64(d.Col)-half)/scale), int((float64(d.Row)-half)/scale),
+			int((float64(d.Col)+half)/scale), int((float64(d.Row)+half)/scale),
+		).Add(bounds.Min).Intersect(bounds)
+		if !face.Empty() {
+			faces = append(faces, face)
+		}
+	}
+
+	return faces
+}
+
+func (fd *FaceDetector) resize(i image.Image, width, height uint) image.Image {
+	return (&ProfileConfig{Filter: "bilinear"}).Resizer().Resize(i, width, height)
+}
+
+func area(r image.Rectangle) float64 {
+	return float64(r.Dx()) * float64(r.Dy())
+}
+
+// Scores a crop by the faces it keeps, a face cut in half is worse
+// than one left out entirely.
+func faceScore(crop image.Rectangle, faces []image.Rectangle) float64 {
+	score := 0.0
+	for _, face := range faces {
+		inside := area(crop.Intersect(face)) / area(face)
+		switch {
+		case inside > 0.99:
+			score += area(face)
+		case inside > 0:
+			score -= 2 * area(face) * (1 - inside)
+		}
+	}
+	return score
+}
+
+// Crops are weighed on a copy this size, big enough to tell detail
+// apart and small enough to try a lot of crops.
+const cropAnalysisSize = 160
+
+// Picks a square crop by scoring candidates of a few sizes on their
+// detail, weighted toward the middle the way smartcrop does, plus the
+// share of the faces they keep whole. A crop that cuts faces loses
+// more than it would gain from detail.
+func faceAwareCrop(i image.Image, faces []image.Rectangle) image.Rectangle {
+	bounds := i.Bounds()
+
+	scale := math.Min(1, float64(cropAnalysisSize)/float64(max(bounds.Dx(), bounds.Dy())))
+	width := max(3, int(float64(bounds.Dx())*scale))
+	height := max(3, int(float64(bounds.Dy())*scale))
+	small := toRGBA((&ProfileConfig{Filter: "bilinear"}).Resizer().Resize(i, uint(width), uint(height)))
+
+	interests := make([]float64, width*height)
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			interests[y*width+x] = interest(small, x, y)
+		}
+	}
+
+	faceArea := 0.0
+	for _, face := range faces {
+		faceArea += area(face)
+	}
+
+	best := image.Rectangle{}
+	bestScore := math.Inf(-1)
+
+	for _, factor := range []float64{1, 0.9, 0.8, 0.7} {
+		side := max(1, int(float64(min(width, height))*factor))
+		original := min(int(float64(side)/scale), bounds.Dx(), bounds.Dy())
+
+		stepX := max(1, (width-side)/24)
+		stepY := max(1, (height-side)/24)
+		for y := 0; y+side <= height; y += stepY {
+			for x := 0; x+side <= width; x += stepX {
+				// Every other pixel is plenty to compare crops by.
+				score, n := 0.0, 0
+				for cy := y; cy < y+side; cy += 2 {
+					for cx := x; cx < x+side; cx += 2 {
+						// Distance from the crop's middle, 0 to 1 on each axis.
+						dx := math.Abs(2*(float64(cx-x)+0.5)/float64(side) - 1)
+						dy := math.Abs(2*(float64(cy-y)+0.5)/float64(side) - 1)
+						score += interests[cy*width+cx] * (1 - 0.5*math.Max(dx, dy))
+						n++
+					}
+				}
+				score /= float64(n)
+
+				left := min(bounds.Min.X+int(float64(x)/scale), bounds.Max.X-original)
+				top := min(bounds.Min.Y+int(float64(y)/scale), bounds.Max.Y-original)
+				crop := image.Rect(left, top, left+original, top+original)
+
+				if faceArea > 0 {
+					score += faceScore(crop, faces) / faceArea
+				}
+
+				if score > bestScore {
+					best, bestScore = crop, score
+				}
+			}
+		}
+	}
+
+	return best
+}
+
+func drawOutline(i draw.Image, r image.Rectangle, c color.Color, width int) {
+	for w := 0; w < width; w++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			i.Set(x, r.Min.Y+w, c)
+			i.Set(x, r.Max.Y-1-w, c)
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			i.Set(r.Min.X+w, y, c)
+			i.Set(r.Max.X-1-w, y, c)
+		}
+	}
+}
+
+// Writes the source with its faces in red, smartcrop's suggestion in
+// blue and the crop we used in green.
+func (g *Generator) WriteCropOverlay(source string, i image.Image, faces []image.Rectangle, suggested, chosen image.Rectangle) error {
+	bounds := i.Bounds()
+	overlay := image.NewRGBA(bounds)
+	draw.Draw(overlay, bounds, i, bounds.Min, draw.Src)
+
+	width := max(2, min(bounds.Dx(), bounds.Dy())/200)
+	for _, face := range faces {
+		drawOutline(overlay, face, color.RGBA{255, 0, 0, 255}, width)
+	}
+	drawOutline(overlay, suggested, color.RGBA{0, 0, 255, 255}, width)
+	drawOutline(overlay, chosen, color.RGBA{0, 255, 0, 255}, width)
+
+	path := filepath.Join(g.Config.Faces.Debug, derivativeName(source))
+
+	data, err := encodeJpeg(overlay, DefaultJpegQuality)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("writing crop overlay %s (%d faces)", path, len(faces))
+
+	return g.SaveJpeg(data, path, nil)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// A front matter key to set, "table.key" for keys in a table like
+// Zola's extra.
+type FrontMatterValue struct {
+	Key   string
+	Value string
+}
+
+// Sets keys in a markdown file's front matter, so generated values
+// reach pages that were written once and then edited by hand. YAML
+// (---) and TOML (+++) front matter are supported, keys with an empty
+// value are removed and pages without front matter are left alone.
+func UpdateFrontMatter(path string, values []FrontMatterValue) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(data), "\n")
+
+	delimiter := strings.TrimSpace(lines[0])
+	if delimiter != "---" && delimiter != "+++" {
+		log.Printf("%s has no front matter, leaving it alone", path)
+		return nil
+	}
+
+	end := -1
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == delimiter {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return fmt.Errorf("%s: unterminated front matter", path)
+	}
+
+	fm := &frontMatter{
+		lines: append([]string{}, lines[1:end]...),
+		toml:  delimiter == "+++",
+	}
+
+	for _, v := range values {
+		err := fm.set(v.Key, v.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	updated := append(append([]string{lines[0]}, fm.lines...), lines[end:]...)
+	output := strings.Join(updated, "\n")
+	if output == string(data) {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, []byte(output), info.Mode())
+}
+
+// Just enough of YAML and TOML to find keys at the top level and in
+// tables one level down, everything else is kept as it was.
+type frontMatter struct {
+	lines []string
+	toml  bool
+}
+
+func (f *frontMatter) header(table string) string {
+	if f.toml {
+		return "[" + table + "]"
+	}
+	return table + ":"
+}
+
+// The lines holding a table's keys, the top level for an empty name.
+func (f *frontMatter) table(name string) (int, int, bool) {
+	if name == "" {
+		end := len(f.lines)
+		if f.toml {
+			for i, l := range f.lines {
+				if strings.HasPrefix(strings.TrimSpace(l), "[") {
+					end = i
+					break
+				}
+			}
+		}
+		return 0, end, true
+	}
+
+	for i, l := range f.lines {
+		if strings.TrimRight(l, " \t") != f.header(name) {
+			continue
+		}
+
+		end := i + 1
+		for ; end < len(f.lines); end++ {
+			l := f.lines[end]
+			if f.toml && strings.HasPrefix(strings.TrimSpace(l), "[") {
+				break
+			}
+			if !f.toml && l != "" && !strings.HasPrefix(l, " ") {
+				break
+			}
+		}
+		return i + 1, end, true
+	}
+
+	return 0, 0, false
+}
+
+func (f *frontMatter) keyOf(line string, nested bool) string {
+	if !f.toml && !nested && strings.HasPrefix(line, " ") {
+		return ""
+	}
+
+	separator := ":"
+	if f.toml {
+		separator = "="
+	}
+
+	i := strings.Index(line, separator)
+	if i < 0 {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(line[:i]), `"'`)
+}
+
+// How a table's keys are indented, going by its first one. New YAML
+// tables get two spaces and TOML ones none.
+func (f *frontMatter) indent(name string, start, end int) string {
+	if name == "" {
+		return ""
+	}
+	for _, l := range f.lines[start:end] {
+		if strings.TrimSpace(l) != "" {
+			return l[:len(l)-len(strings.TrimLeft(l, " \t"))]
+		}
+	}
+	if f.toml {
+		return ""
+	}
+	return "  "
+}
+
+func (f *frontMatter) line(key, value, indent string) (string, error) {
+	quoted, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	if f.toml {
+		return indent + key + " = " + string(quoted), nil
+	}
+	return indent + key + ": " + string(quoted), nil
+}
+
+func (f *frontMatter) set(path, value string) error {
+	table, key := "", path
+	if i := strings.Index(path, "."); i >= 0 {
+		table, key = path[:i], path[i+1:]
+	}
+	nested := table != ""
+
+	start, end, ok := f.table(table)
+
+	line, err := f.line(key, value, f.indent(table, start, end))
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		if value == "" {
+			return nil
+		}
+		f.lines = append(f.lines, f.header(table), line)
+		return nil
+	}
+
+	for i := start; i < end; i++ {
+		if f.keyOf(f.lines[i], nested) != key {
+			continue
+		}
+
+		if value != "" {
+			f.lines[i] = line
+			return nil
+		}
+
+		f.lines = append(f.lines[:i], f.lines[i+1:]...)
+		end--
+
+		// Don't leave an empty table behind.
+		empty := true
+		for j := start; j < end; j++ {
+			empty = empty && strings.TrimSpace(f.lines[j]) == ""
+		}
+		if nested && empty {
+			f.lines = append(f.lines[:start-1], f.lines[end:]...)
+		}
+		return nil
+	}
+
+	if value == "" {
+		return nil
+	}
+
+	// After the table's last key, not after the blank lines that
+	// separate it from what follows.
+	insert := end
+	for insert > start && strings.TrimSpace(f.lines[insert-1]) == "" {
+		insert--
+	}
+
+	f.lines = append(f.lines[:insert], append([]string{line}, f.lines[insert:]...)...)
+
+	return nil
+}
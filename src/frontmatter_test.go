@@ -0,0 +1,200 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUpdateFrontMatter(t *testing.T) {
+	tests := []struct {
+		name     string
+		page     string
+		values   []FrontMatterValue
+		expected string
+	}{
+		{
+			"yaml top level",
+			"---\ntitle: \"Old\"\ndate: 2020\n---\nbody\n",
+			[]FrontMatterValue{{"title", "New"}},
+			"---\ntitle: \"New\"\ndate: 2020\n---\nbody\n",
+		},
+		{
+			"yaml adds a table",
+			"---\ntitle: \"A\"\n---\n",
+			[]FrontMatterValue{{"extra.cover", "a.jpg"}},
+			"---\ntitle: \"A\"\nextra:\n  cover: \"a.jpg\"\n---\n",
+		},
+		{
+			"yaml keeps the table's indent",
+			"---\nextra:\n    toc: true\n---\n",
+			[]FrontMatterValue{{"extra.cover", "a.jpg"}},
+			"---\nextra:\n    toc: true\n    cover: \"a.jpg\"\n---\n",
+		},
+		{
+			"yaml replaces nested only",
+			"---\ncover: \"top\"\nextra:\n  cover: \"old\"\n---\n",
+			[]FrontMatterValue{{"extra.cover", "new"}},
+			"---\ncover: \"top\"\nextra:\n  cover: \"new\"\n---\n",
+		},
+		{
+			"yaml removes the last key and its table",
+			"---\ntitle: \"A\"\nextra:\n  cover: \"a.jpg\"\n---\n",
+			[]FrontMatterValue{{"extra.cover", ""}},
+			"---\ntitle: \"A\"\n---\n",
+		},
+		{
+			"toml adds a table",
+			"+++\ntitle = \"A\"\n+++\n",
+			[]FrontMatterValue{{"extra.cover", "a.jpg"}},
+			"+++\ntitle = \"A\"\n[extra]\ncover = \"a.jpg\"\n+++\n",
+		},
+		{
+			"toml top level goes before tables",
+			"+++\ntitle = \"A\"\n\n[extra]\ntoc = true\n+++\n",
+			[]FrontMatterValue{{"date", "2020-01-01"}},
+			"+++\ntitle = \"A\"\ndate = \"2020-01-01\"\n\n[extra]\ntoc = true\n+++\n",
+		},
+		{
+			"toml keeps the table's indent",
+			"+++\n[extra]\n  toc = true\n+++\n",
+			[]FrontMatterValue{{"extra.cover", "a.jpg"}},
+			"+++\n[extra]\n  toc = true\n  cover = \"a.jpg\"\n+++\n",
+		},
+		{
+			"toml inserts before the blank line ending the table",
+			"+++\n[extra]\ntoc = true\n\n[taxonomies]\ntags = []\n+++\n",
+			[]FrontMatterValue{{"extra.cover", "a.jpg"}},
+			"+++\n[extra]\ntoc = true\ncover = \"a.jpg\"\n\n[taxonomies]\ntags = []\n+++\n",
+		},
+		{
+			"removing a missing key changes nothing",
+			"+++\ntitle = \"A\"\n+++\n",
+			[]FrontMatterValue{{"extra.cover", ""}, {"date", ""}},
+			"+++\ntitle = \"A\"\n+++\n",
+		},
+		{
+			"values are quoted",
+			"---\n---\n",
+			[]FrontMatterValue{{"title", "Say \"hi\""}},
+			"---\ntitle: \"Say \\\"hi\\\"\"\n---\n",
+		},
+		{
+			"no front matter",
+			"# Just markdown\n",
+			[]FrontMatterValue{{"title", "A"}},
+			"# Just markdown\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "page.md")
+			if err := ioutil.WriteFile(path, []byte(test.page), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := UpdateFrontMatter(path, test.values); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.expected {
+				t.Fatalf("expected\n%s\ngot\n%s", test.expected, data)
+			}
+		})
+	}
+}
+
+func TestUpdateFrontMatterUnterminated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "page.md")
+	if err := ioutil.WriteFile(path, []byte("---\ntitle: \"A\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := UpdateFrontMatter(path, []FrontMatterValue{{"title", "B"}})
+	if err == nil || !strings.Contains(err.Error(), "unterminated") {
+		t.Fatalf("expected an unterminated front matter error, got %v", err)
+	}
+}
+
+func TestFrontMatterValues(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "content", "albums")
+	g := &Generator{AlbumsRoot: root}
+
+	cover := &AlbumCover{
+		Cover:  &ImageMeta{Path: filepath.Join(root, "cover", "a.jpg")},
+		Social: &ImageMeta{Path: filepath.Join(root, "social", "a.jpg")},
+	}
+	collage := &ImageMeta{Path: filepath.Join(root, "trip.collage.jpg")}
+
+	tests := []struct {
+		name     string
+		album    *Album
+		expected map[string]string
+	}{
+		{
+			"nothing generated",
+			&Album{Config: &AlbumConfig{Title: "Trip", PathName: "trip"}},
+			map[string]string{},
+		},
+		{
+			"cover only",
+			&Album{Config: &AlbumConfig{Title: "Trip", PathName: "trip"}, Cover: cover},
+			map[string]string{
+				"extra.cover":            "albums/cover/a.jpg",
+				"extra.social_image":     "albums/social/a.jpg",
+				"extra.static_thumbnail": "albums/social/a.jpg",
+			},
+		},
+		{
+			"collage is the thumbnail",
+			&Album{Config: &AlbumConfig{Title: "Trip", PathName: "trip"}, Cover: cover, Collage: collage},
+			map[string]string{
+				"extra.cover":            "albums/cover/a.jpg",
+				"extra.social_image":     "albums/social/a.jpg",
+				"extra.collage":          "albums/trip.collage.jpg",
+				"extra.static_thumbnail": "albums/trip.collage.jpg",
+			},
+		},
+		{
+			"first page",
+			&Album{Config: &AlbumConfig{Title: "Trip", PathName: "trip"}, Page: &AlbumPage{Number: 1, Pages: 2, Name: "trip", Next: "trip-page-2"}},
+			map[string]string{
+				"extra.next": "albums/trip-page-2.md",
+			},
+		},
+		{
+			"later page",
+			&Album{Config: &AlbumConfig{Title: "Trip", PathName: "trip"}, Page: &AlbumPage{Number: 2, Pages: 3, Name: "trip-page-2", Previous: "trip", Next: "trip-page-3"}},
+			map[string]string{
+				"title":          "Trip (page 2 of 3)",
+				"extra.previous": "albums/trip.md",
+				"extra.next":     "albums/trip-page-3.md",
+				"extra.page_of":  "albums/trip.md",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values := make(map[string]string)
+			for _, v := range g.FrontMatter(test.album) {
+				if _, ok := values[v.Key]; ok {
+					t.Fatalf("%s is set twice", v.Key)
+				}
+				if v.Value != "" {
+					values[v.Key] = v.Value
+				}
+			}
+			if !reflect.DeepEqual(values, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, values)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"image"
@@ -15,8 +16,6 @@ import (
 	"encoding/json"
 	"encoding/xml"
 
-	"image/jpeg"
-
 	texttemplate "text/template"
 
 	"github.com/muesli/smartcrop"
@@ -35,6 +34,12 @@ type AlbumFile struct {
 	Xmp          *XmpFile
 	Original     *ImageMeta
 	Large        *ImageMeta
+	Small        *ImageMeta
+	Location     *Location
+	Place        *Place
+	Edits        *EditSummary
+	Focus        *FocalPoint
+	Placeholder  *Placeholder
 }
 
 var (
@@ -42,20 +47,33 @@ var (
 )
 
 type Album struct {
-	Config *AlbumConfig
-	Files  []*AlbumFile
-	Date   time.Time
+	Config  *AlbumConfig
+	Files   []*AlbumFile
+	Date    time.Time
+	Cover   *AlbumCover
+	Collage *ImageMeta
+	Teaser  *ImageMeta
+	Layouts []*GalleryLayout
+	Page    *AlbumPage
 }
 
 type CachedImage struct {
-	Path  string
-	Image image.Image
+	Path    string
+	Image   image.Image
+	Profile *IccProfile
 }
 
 type Cache struct {
-	XmpsByBaseName map[string]string
-	AllAlbums      []*Album
-	Images         CachedImage
+	XmpsByBaseName    map[string]string
+	RecordsByBaseName map[string]*XmpFile
+	ExportsByBaseName map[string]string
+	SourcesByName     map[string]string
+	MetadataSource    string
+	AllAlbums         []*Album
+	Images            CachedImage
+	Tracks            map[string]*Track
+	Geotaggers        map[*GpxConfig]*Geotagger
+	Places            *Gazetteer
 }
 
 func (c *Cache) Load(path string) (image.Image, error) {
@@ -63,20 +81,24 @@ func (c *Cache) Load(path string) (image.Image, error) {
 		return c.Images.Image, nil
 	}
 
-	file, err := os.Open(path)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	defer file.Close()
-
-	i, _, err := image.Decode(file)
+	i, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
 
+	profile, err := extractIcc(data)
+	if err != nil {
+		log.Printf("%s: ignoring color profile: %v", path, err)
+	}
+
 	c.Images.Path = path
-	c.Images.Image = i
+	c.Images.Image = normalizeImage(i)
+	c.Images.Profile = profile
 
 	return c.Images.Image, nil
 }
@@ -95,13 +117,46 @@ func (c *Cache) Fill(o *Configuration) error {
 	}
 
 	c.XmpsByBaseName = make(map[string]string)
+	c.RecordsByBaseName = make(map[string]*XmpFile)
+	c.ExportsByBaseName = make(map[string]string)
+	c.SourcesByName = make(map[string]string)
+	c.Tracks = make(map[string]*Track)
+	c.Geotaggers = make(map[*GpxConfig]*Geotagger)
+
+	if o.Places != nil {
+		places, err := NewGazetteer(o.Places)
+		if err != nil {
+			return err
+		}
+		c.Places = places
+	}
 
-	if err := c.AddExtensions(o, ".arw.xmp"); err != nil {
-		return err
+	c.MetadataSource = o.Library.Source
+	if c.MetadataSource == "" {
+		c.MetadataSource = MetadataSourceXmp
 	}
-	if err := c.AddExtensions(o, ".jpg.xmp"); err != nil {
-		return err
+
+	switch c.MetadataSource {
+	case MetadataSourceXmp, MetadataSourceDatabase, MetadataSourceMerge:
+	default:
+		return fmt.Errorf("unknown metadata source: '%s'", c.MetadataSource)
 	}
+
+	if c.MetadataSource != MetadataSourceDatabase {
+		if err := c.AddExtensions(o, ".arw.xmp"); err != nil {
+			return err
+		}
+		if err := c.AddExtensions(o, ".jpg.xmp"); err != nil {
+			return err
+		}
+	}
+
+	if c.MetadataSource != MetadataSourceXmp {
+		if err := c.AddDatabase(o); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -135,6 +190,40 @@ func (c *Cache) FindXmp(name string) (string, error) {
 	return "", nil
 }
 
+// Returns the metadata for a photo, from its side car, darktable's
+// library or both depending on configuration, along with the side car
+// path. The path may not exist when using the library alone.
+func (c *Cache) FindMetadata(name string) (*XmpFile, string, error) {
+	xmpPath, err := c.FindXmp(name)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(xmpPath) == 0 {
+		return nil, "", nil
+	}
+
+	record := c.RecordsByBaseName[removeAllExtensions(name)]
+
+	var xmp *XmpFile
+	if c.MetadataSource != MetadataSourceDatabase {
+		if _, err := os.Stat(xmpPath); err == nil {
+			xmp, err = openXmp(xmpPath)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	switch {
+	case xmp == nil:
+		xmp = record
+	case record != nil:
+		xmp = mergeMetadata(xmp, record)
+	}
+
+	return xmp, xmpPath, nil
+}
+
 type Subjects struct {
 	Subjects []string `xml:"Bag>li"`
 }
@@ -151,10 +240,22 @@ type RdfDescription struct {
 	Rating           int64  `xml:"Rating,attr"`
 	DateTimeOriginal string `xml:"DateTimeOriginal,attr"`
 	DerivedFrom      string `xml:"DerivedFrom,attr"`
+	HistoryEnd       *int64 `xml:"history_end,attr"`
+	ChangeTimestamp  string `xml:"change_timestamp,attr"`
+	IopOrderList     string `xml:"iop_order_list,attr" json:"-"`
+	GPSLatitude      string `xml:"GPSLatitude,attr"`
+	GPSLongitude     string `xml:"GPSLongitude,attr"`
+	GPSAltitude      string `xml:"GPSAltitude,attr"`
+	GPSAltitudeRef   string `xml:"GPSAltitudeRef,attr"`
 
 	Subjects             Subjects             `xml:"subject"`
 	HierarchicalSubjects HierarchicalSubjects `xml:"hierarchicalSubject"`
-	History              []DarkTableHistory   `xml:"history>Seq>li"`
+	ColorLabels          []string             `xml:"colorlabels>Seq>li"`
+	History              []DarkTableHistory   `xml:"history>Seq>li" json:"-"`
+	Creator              []string             `xml:"creator>Seq>li"`
+	Rights               []string             `xml:"rights>Alt>li"`
+	Title                []string             `xml:"title>Alt>li"`
+	Caption              []string             `xml:"description>Alt>li"`
 }
 
 type DarkTableHistory struct {
@@ -194,9 +295,10 @@ func openXmp(path string) (*XmpFile, error) {
 }
 
 type ImageMeta struct {
-	Path string
-	Dx   uint
-	Dy   uint
+	Path   string
+	Dx     uint
+	Dy     uint
+	Policy string `json:",omitempty"`
 }
 
 func getImageMeta(path string) (im *ImageMeta, err error) {
@@ -223,13 +325,34 @@ func getImageMeta(path string) (im *ImageMeta, err error) {
 
 type Generator struct {
 	Cache      *Cache
+	Config     *Configuration
+	Report     *Report
+	Manifest   *Manifest
+	Faces      *FaceDetector
+	Overrides  map[string]*CropOverride
 	AlbumsRoot string
+	Mode       GeneratorMode
+
+	// Crop overrides by source, including photos without one.
+	cropOverrides map[string]*CropOverride
 }
 
-func NewGenerator(configPath, albumsRoot string) (g *Generator, err error) {
+// GeneratorMode says what a generator is for. Publishing exports
+// missing raws and checks exports are current, the other subcommands
+// only read the albums as they are and leave both alone.
+type GeneratorMode int
+
+const (
+	PublishMode GeneratorMode = iota
+	ReadMode
+)
+
+func NewGenerator(configPath, albumsRoot string, mode GeneratorMode) (g *Generator, err error) {
 	g = &Generator{
 		Cache:      &Cache{},
+		Report:     &Report{},
 		AlbumsRoot: albumsRoot,
+		Mode:       mode,
 	}
 
 	cfg, err := g.OpenConfiguration(configPath)
@@ -237,6 +360,51 @@ func NewGenerator(configPath, albumsRoot string) (g *Generator, err error) {
 		return nil, err
 	}
 
+	g.Config = cfg
+
+	err = g.CheckProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Export != nil {
+		err = cfg.Export.Check()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Layout != nil {
+		err = cfg.Layout.Check()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, album := range cfg.Albums {
+		err = album.CheckExclude()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	g.Manifest, err = OpenManifest(albumsRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	g.Overrides, err = OpenOverrides(albumsRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Faces != nil {
+		g.Faces, err = NewFaceDetector(cfg.Faces)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// This scans the library and looks for side car files, then opens
 	// those side car files and tries to find photos that belong in
 	// one of our albums.
@@ -249,7 +417,24 @@ func NewGenerator(configPath, albumsRoot string) (g *Generator, err error) {
 	// images and tries to see if one of them has a corresponding XMP
 	// that we found earlier.
 	for _, source := range cfg.Sources {
-		err = g.IncludeDirectory(source)
+		err = g.IncludeSource(source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Raws that belong in an album but were never exported can be
+	// handed to an external command, and we include whatever it
+	// produces.
+	if cfg.Export != nil && mode == PublishMode {
+		err = g.ExportMissing()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Stale != nil && mode == PublishMode {
+		err = g.CheckMissing()
 		if err != nil {
 			return nil, err
 		}
@@ -267,19 +452,20 @@ func (g *Generator) IncludeImage(path string) error {
 	// We rely on images having globally unique file names, which is
 	// risky but would be annoying to deal with otherwise. This takes
 	// the base name of the exported image and tries to find it's XMP.
-	name := filepath.Base(path)
-	xmpPath, err := g.Cache.FindXmp(name)
+	name := derivativeName(path)
+	xmp, xmpPath, err := g.Cache.FindMetadata(name)
+
 	if err != nil {
 		return err
 	}
-	if len(xmpPath) == 0 {
+	if xmp == nil {
 		if verbose {
 			log.Printf("missing xmp: %v (%v)", path, name)
 		}
 		return nil
 	}
 
-	xmp, err := openXmp(xmpPath)
+	err = g.Cache.ClaimName(name, path)
 	if err != nil {
 		return err
 	}
@@ -298,69 +484,150 @@ func (g *Generator) IncludeImage(path string) error {
 		createdAt = dto
 	}
 
-	tags := make(map[string]bool)
+	g.Cache.ExportsByBaseName[removeAllExtensions(name)] = path
 
-	for _, hs := range xmp.Rdf.Description.HierarchicalSubjects.Subjects {
-		tags[hs] = true
+	matches, err := g.MatchAlbums(xmpPath, xmp)
+	if err != nil {
+		return err
 	}
 
-	for _, album := range g.Cache.AllAlbums {
-		matches := true
+	if tag := g.ExcludedByTag(xmp); tag != "" {
+		// Photos in no album weren't going anywhere anyway.
+		if len(matches) > 0 {
+			g.Report.Exclude("", "tag:"+tag)
+		}
+		if verbose {
+			log.Printf("excluding %v (%v)", path, tag)
+		}
+		return nil
+	}
 
-		for _, tag := range album.Config.Tags {
-			if _, ok := tags[tag]; !ok {
-				if verbose {
-					log.Printf("missing tag %v (%v)", tags, tag)
-				}
-				matches = false
-				break
-			}
+	// Only photos that would be published can be stale.
+	if g.Config.Stale != nil && g.Mode == PublishMode && len(matches) > 0 {
+		err = g.CheckStale(path, xmpPath, xmp)
+		if err != nil {
+			return err
 		}
+	}
 
-		if matches {
-			af := &AlbumFile{
-				OriginalPath: path,
-				PhotoPath:    name,
-				CreatedAt:    createdAt,
-				Name:         name,
-				Original:     originalMeta,
-				Large:        CalculateNewSizes(g.AlbumsRoot, originalMeta, 1600, 1200, "large"),
-				Xmp:          xmp,
-			}
+	edits := summarizeEdits(xmp)
+
+	var focus *FocalPoint
+	if override := g.CropOverrideFrom(path, xmp); override != nil {
+		focus = override.FocalPoint()
+	}
 
+	for _, match := range matches {
+		album := match.Album
+
+		if pattern := album.Config.ExcludedFile(name); pattern != "" {
+			g.Report.Exclude(album.Config.PathName, "file:"+pattern)
 			if verbose {
-				log.Printf("adding to album '%s' (%v) : %v", album.Config.Title, album.Config.Tags, af.PhotoPath)
+				log.Printf("excluding %v from '%s' (%v)", path, album.Config.Title, pattern)
 			}
+			continue
+		}
 
-			album.Files = append(album.Files, af)
-			album.Date = af.CreatedAt
+		af := &AlbumFile{
+			OriginalPath: path,
+			PhotoPath:    name,
+			CreatedAt:    createdAt,
+			Name:         name,
+			Original:     originalMeta,
+			Large:        CalculateNewSizes(g.AlbumsRoot, originalMeta, g.Profile(ProfileLarge), "large"),
+			Small:        CalculateNewSizes(g.AlbumsRoot, originalMeta, g.Profile(ProfileSmall), "small"),
+			Xmp:          xmp,
+			Location:     match.Location,
+			Place:        match.Place,
+			Edits:        edits,
+			Focus:        focus,
+		}
+
+		if verbose {
+			log.Printf("adding to album '%s' (%v) : %v", album.Config.Title, album.Config.Tags, af.PhotoPath)
 		}
 
+		album.Files = append(album.Files, af)
+		album.Date = af.CreatedAt
 	}
 
 	return nil
 }
 
-func (g *Generator) IncludeDirectory(path string) error {
-	err := filepath.Walk(path, func(path string, info os.FileInfo, e error) error {
-		if e != nil {
-			return e
+type AlbumMatch struct {
+	Album    *Album
+	Location *Location
+	Place    *Place
+}
+
+func (g *Generator) MatchAlbums(xmpPath string, xmp *XmpFile) ([]*AlbumMatch, error) {
+	tags := make(map[string]bool)
+
+	for _, hs := range xmp.Rdf.Description.HierarchicalSubjects.Subjects {
+		tags[hs] = true
+	}
+
+	// Photos with native GPS keep it. One bad value shouldn't stop
+	// the run, the photo just goes without.
+	native, err := xmpLocation(xmp)
+	if err != nil {
+		log.Printf("%s: %v, treating it as unlocated", xmpPath, err)
+		native = nil
+	}
+
+	// Albums usually share a track, each is only asked once.
+	tracked := make(map[*GpxConfig]*Location)
+
+	matches := make([]*AlbumMatch, 0)
+
+	for _, album := range g.Cache.AllAlbums {
+		// Location can come from an album's track, so the place and
+		// the automatic tags derived from it are per album.
+		location := native
+		if location == nil {
+			cfg := g.TrackConfig(album)
+			l, ok := tracked[cfg]
+			if !ok {
+				l, err = g.TrackLocation(cfg, xmpPath, xmp)
+				if err != nil {
+					return nil, err
+				}
+				tracked[cfg] = l
+			}
+			location = l
 		}
 
-		if info.Mode().IsRegular() {
-			fileExt := strings.ToLower(filepath.Ext(info.Name()))
+		var place *Place
+		if g.Cache.Places != nil {
+			place = g.Cache.Places.Lookup(location)
+		}
 
-			if !strings.HasSuffix(info.Name(), ".haar.jpg") && !strings.HasSuffix(info.Name(), ".cnn.jpg") {
-				if fileExt == ".jpg" {
-					err := g.IncludeImage(path)
-					if err != nil {
-						return err
-					}
+		matched := true
+
+		for _, tag := range album.Config.Tags {
+			if _, ok := tags[tag]; !ok && !hasTag(place.Tags(), tag) {
+				if verbose {
+					log.Printf("missing tag %v (%v)", tags, tag)
 				}
+				matched = false
+				break
 			}
 		}
-		return nil
-	})
+
+		if matched {
+			matches = append(matches, &AlbumMatch{
+				Album:    album,
+				Location: location,
+				Place:    place,
+			})
+		}
+	}
+
+	return matches, nil
+}
+
+func (g *Generator) IncludeSource(source *SourceConfig) error {
+	err := source.Walk(g.IncludeImage)
 	if err != nil {
 		return err
 	}
@@ -369,19 +636,41 @@ func (g *Generator) IncludeDirectory(path string) error {
 }
 
 type Configuration struct {
-	Sources []string       `json:"sources"`
-	Library *LibraryConfig `json:"library"`
-	Albums  []*AlbumConfig `json:"albums"`
+	Sources []*SourceConfig `json:"sources"`
+	Library *LibraryConfig  `json:"library"`
+	Albums  []*AlbumConfig  `json:"albums"`
+	Gpx     *GpxConfig      `json:"gpx"`
+	Places  *PlacesConfig   `json:"places"`
+	Stale   *StaleConfig    `json:"stale"`
+	Export  *ExportConfig   `json:"export"`
+
+	Profiles map[string]*ProfileConfig `json:"profiles"`
+	Metadata *MetadataConfig           `json:"metadata"`
+	Faces    *FacesConfig              `json:"faces"`
+
+	Duplicates *DuplicatesConfig `json:"duplicates"`
+	Collage    *CollageConfig    `json:"collage"`
+	Teaser     *TeaserConfig     `json:"teaser"`
+	Layout     *LayoutConfig     `json:"layout"`
+
+	ExcludeTags []string `json:"exclude_tags"`
 }
 
 type LibraryConfig struct {
-	Path string `json:"path"`
+	Path     string `json:"path"`
+	Database string `json:"database"`
+	Data     string `json:"data"`
+	Source   string `json:"source"`
 }
 
 type AlbumConfig struct {
-	Title    string   `json:"title"`
-	PathName string   `json:"path"`
-	Tags     []string `json:"tags"`
+	Title    string     `json:"title"`
+	PathName string     `json:"path"`
+	Tags     []string   `json:"tags"`
+	Exclude  []string   `json:"exclude"`
+	Cover    string     `json:"cover"`
+	PageSize int        `json:"page_size"`
+	Gpx      *GpxConfig `json:"gpx"`
 }
 
 func (g *Generator) OpenConfiguration(path string) (*Configuration, error) {
@@ -403,7 +692,9 @@ func (g *Generator) OpenConfiguration(path string) (*Configuration, error) {
 	return cfg, nil
 }
 
-func (g *Generator) SaveJpeg(image image.Image, path string) error {
+// Segments are written right after the start of image marker, the
+// encoder doesn't write any application segments of its own.
+func (g *Generator) SaveJpeg(data []byte, path string, segments [][]byte) error {
 	err := os.MkdirAll(filepath.Dir(path), 755)
 	if err != nil {
 		return err
@@ -414,11 +705,21 @@ func (g *Generator) SaveJpeg(image image.Image, path string) error {
 		return err
 	}
 
-	options := jpeg.Options{
-		Quality: 80,
+	defer file.Close()
+
+	_, err = file.Write(data[:2])
+	if err != nil {
+		return err
 	}
 
-	err = jpeg.Encode(file, image, &options)
+	for _, segment := range segments {
+		_, err = file.Write(segment)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = file.Write(data[2:])
 	if err != nil {
 		return err
 	}
@@ -426,8 +727,98 @@ func (g *Generator) SaveJpeg(image image.Image, path string) error {
 	return nil
 }
 
+// Saves a derivative of source made with the named profile, and
+// records how it was made in the manifest.
+func (g *Generator) SaveDerivative(i image.Image, source, path, profileName string) error {
+	profile := g.Profile(profileName)
+
+	_, err := g.Cache.Load(source)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := g.PhotoMetadata(source, profile.Metadata)
+	if err != nil {
+		return err
+	}
+
+	managed, iccSegments, color := manageColor(i, g.Cache.Images.Profile, profile.Color)
+
+	segments, err := metadata.JpegSegments()
+	if err != nil {
+		return fmt.Errorf("%s: %v", source, err)
+	}
+	segments = append(segments, iccSegments...)
+
+	overhead := 0
+	for _, segment := range segments {
+		overhead += len(segment)
+	}
+
+	data, quality, err := profile.EncodeJpeg(managed, overhead)
+	if err != nil {
+		return err
+	}
+
+	err = g.SaveJpeg(data, path, segments)
+	if err != nil {
+		return err
+	}
+
+	g.Manifest.Record(path, &DerivativeRecord{
+		Source:   source,
+		Profile:  profileName,
+		Settings: g.derivativeSettings(profileName, source, metadata),
+		Color:    color,
+		Metadata: metadata,
+		Quality:  quality,
+		Bytes:    len(data) + overhead,
+	})
+
+	return nil
+}
+
+// Derivatives are also remade when the metadata we'd write changes.
+func (g *Generator) IsCurrent(path, source, profileName string) bool {
+	profile := g.Profile(profileName)
+
+	metadata, err := g.PhotoMetadata(source, profile.Metadata)
+	if err != nil {
+		return false
+	}
+
+	return g.Manifest.Current(path, source, g.derivativeSettings(profileName, source, metadata))
+}
+
+func (g *Generator) derivativeSettings(profileName, source string, metadata *PhotoMetadata) string {
+	profile := g.Profile(profileName)
+	settings := profile.Settings() + metadata.Settings()
+
+	// Face detection only changes how thumbnails are cropped.
+	if profileName == ProfileThumbnail && g.Config.Faces != nil {
+		faces, err := json.Marshal(g.Config.Faces)
+		if err != nil {
+			panic(err)
+		}
+		settings += string(faces)
+	}
+
+	// Overrides change anything that's cropped.
+	if profileName == ProfileThumbnail || profile.Fit == FitFill {
+		if override := g.CropOverride(source); override != nil {
+			data, err := json.Marshal(override)
+			if err != nil {
+				panic(err)
+			}
+			settings += string(data)
+		}
+	}
+
+	return settings
+}
+
 func ResizedPath(albumRoot, original string, size string) string {
-	name := filepath.Base(original)
+	name := derivativeName(original)
 	return filepath.Join(albumRoot, size, name)
 }
 
@@ -438,7 +829,7 @@ func ThumbnailPath(albumRoot, original string, size uint) string {
 func (g *Generator) HasAllThumbnails(albumRoot, original string, sizes []uint) bool {
 	for _, size := range sizes {
 		tp := ThumbnailPath(albumRoot, original, size)
-		if _, err := os.Stat(tp); os.IsNotExist(err) {
+		if !g.IsCurrent(tp, original, ProfileThumbnail) {
 			return false
 		}
 	}
@@ -458,8 +849,8 @@ func (g *Generator) Thumbnails(albumRoot, original string, sizes []uint) error {
 
 	for _, size := range sizes {
 		tp := ThumbnailPath(albumRoot, original, size)
-		if _, err := os.Stat(tp); os.IsNotExist(err) {
-			err := g.Thumbnail(originalImage, size, tp)
+		if !g.IsCurrent(tp, original, ProfileThumbnail) {
+			err := g.Thumbnail(original, originalImage, size, tp)
 			if err != nil {
 				return err
 			}
@@ -469,20 +860,41 @@ func (g *Generator) Thumbnails(albumRoot, original string, sizes []uint) error {
 	return nil
 }
 
-func (g *Generator) Thumbnail(original image.Image, size uint, path string) error {
-	resizer := nfnt.NewDefaultResizer()
-	analyzer := smartcrop.NewAnalyzer(resizer)
-	topCrop, _ := analyzer.FindBestCrop(original, int(size), int(size))
+type SubImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
 
-	log.Printf("generating thumbnail %s %dpx", path, size)
+func (g *Generator) Thumbnail(source string, original image.Image, size uint, path string) error {
+	var topCrop image.Rectangle
+
+	if override := g.CropOverride(source); override != nil {
+		topCrop = override.Rectangle(original.Bounds(), int(size), int(size))
+	} else {
+		analyzer := smartcrop.NewAnalyzer(nfnt.NewDefaultResizer())
+		topCrop, _ = analyzer.FindBestCrop(original, int(size), int(size))
+
+		if g.Faces != nil {
+			faces := g.Faces.Detect(original)
+			suggested := topCrop
+			if len(faces) > 0 {
+				topCrop = faceAwareCrop(original, faces)
+			}
 
-	type SubImager interface {
-		SubImage(r image.Rectangle) image.Image
+			if g.Config.Faces.Debug != "" {
+				err := g.WriteCropOverlay(source, original, faces, suggested, topCrop)
+				if err != nil {
+					return err
+				}
+			}
+		}
 	}
+
+	log.Printf("generating thumbnail %s %dpx", path, size)
+
 	cropped := original.(SubImager).SubImage(topCrop)
-	thumb := resizer.Resize(cropped, size, size)
+	thumb := g.Profile(ProfileThumbnail).Resize(cropped, size, size)
 
-	err := g.SaveJpeg(thumb, path)
+	err := g.SaveDerivative(thumb, source, path, ProfileThumbnail)
 	if err != nil {
 		return err
 	}
@@ -490,59 +902,32 @@ func (g *Generator) Thumbnail(original image.Image, size uint, path string) erro
 	return nil
 }
 
-func calculateScalingFactors(width, height uint, oldWidth, oldHeight float64) (scaleX, scaleY float64) {
-	if width == 0 {
-		if height == 0 {
-			scaleX = 1.0
-			scaleY = 1.0
-		} else {
-			scaleY = oldHeight / float64(height)
-			scaleX = scaleY
-		}
-	} else {
-		scaleX = oldWidth / float64(width)
-		if height == 0 {
-			scaleY = scaleX
-		} else {
-			scaleY = oldHeight / float64(height)
-		}
+// Works out the size of a derivative of original under the profile's
+// size policy.
+func CalculateNewSizes(albumsRoot string, original *ImageMeta, profile *ProfileConfig, name string) *ImageMeta {
+	newX, newY := profile.Dimensions(original.Dx, original.Dy)
+
+	return &ImageMeta{
+		Path:   ResizedPath(albumsRoot, original.Path, name),
+		Dx:     newX,
+		Dy:     newY,
+		Policy: profile.Fit,
 	}
-	return
 }
 
-func CalculateNewSizes(albumsRoot string, original *ImageMeta, maxX, maxY uint, name string) *ImageMeta {
-	newX := uint(original.Dx)
-	newY := uint(original.Dy)
-
-	if newX > newY {
-		scaleX, scaleY := calculateScalingFactors(maxX, 0, float64(original.Dx), float64(original.Dy))
-
-		newX = maxX
-		newY = uint(float64(original.Dy) / scaleY)
-
-		if false {
-			log.Printf("resize-y (%d x %d) -> (%d x %d) (%f x %f)", original.Dx, original.Dy, newX, newY, scaleX, scaleY)
-		}
-	} else {
-		scaleX, scaleY := calculateScalingFactors(0, maxY, float64(original.Dx), float64(original.Dy))
-
-		newX = uint(float64(original.Dx) / scaleX)
-		newY = maxY
-
-		if false {
-			log.Printf("resize-x (%d x %d) -> (%d x %d) (%f x %f)", original.Dx, original.Dy, newX, newY, scaleX, scaleY)
-		}
+// Where to crop a photo to fill a width by height box, from its
+// override if it has one and wherever smartcrop likes otherwise.
+func (g *Generator) FillCrop(source string, i image.Image, width, height int) (image.Rectangle, error) {
+	if override := g.CropOverride(source); override != nil {
+		return override.Rectangle(i.Bounds(), width, height), nil
 	}
 
-	return &ImageMeta{
-		Path: ResizedPath(albumsRoot, original.Path, name),
-		Dx:   newX,
-		Dy:   newY,
-	}
+	analyzer := smartcrop.NewAnalyzer(nfnt.NewDefaultResizer())
+	return analyzer.FindBestCrop(i, width, height)
 }
 
-func (g *Generator) ResizePhoto(original string, newSize *ImageMeta) error {
-	if _, err := os.Stat(newSize.Path); !os.IsNotExist(err) {
+func (g *Generator) ResizePhoto(original string, newSize *ImageMeta, profileName string) error {
+	if g.IsCurrent(newSize.Path, original, profileName) {
 		return nil
 	}
 
@@ -553,36 +938,43 @@ func (g *Generator) ResizePhoto(original string, newSize *ImageMeta) error {
 		return err
 	}
 
-	resizer := nfnt.NewDefaultResizer()
-	resizedImage := resizer.Resize(originalImage, newSize.Dx, newSize.Dy)
-	if err != nil {
-		return err
+	profile := g.Profile(profileName)
+
+	// Sizes were planned from the image's header, make sure they
+	// still hold for the pixels we actually decoded.
+	bounds := originalImage.Bounds()
+	newX, newY := profile.Dimensions(uint(bounds.Dx()), uint(bounds.Dy()))
+	if newX != newSize.Dx || newY != newSize.Dy {
+		log.Printf("'%s' decoded as %d x %d, resizing to (%d x %d)", original, bounds.Dx(), bounds.Dy(), newX, newY)
+		newSize.Dx = newX
+		newSize.Dy = newY
 	}
 
-	err = g.SaveJpeg(resizedImage, newSize.Path)
-	if err != nil {
-		return err
+	if profile.Fit == FitFill {
+		crop, err := g.FillCrop(original, originalImage, int(newSize.Dx), int(newSize.Dy))
+		if err != nil {
+			return err
+		}
+		originalImage = originalImage.(SubImager).SubImage(crop)
 	}
 
-	return nil
-}
+	resizedImage := profile.Resize(originalImage, newSize.Dx, newSize.Dy)
 
-func (g *Generator) Resize(albumRoot, original string) error {
-	originalMeta, err := getImageMeta(original)
+	err = g.SaveDerivative(resizedImage, original, newSize.Path, profileName)
 	if err != nil {
 		return err
 	}
 
-	largeSize := CalculateNewSizes(albumRoot, originalMeta, 1600, 1200, "large")
+	return nil
+}
 
-	err = g.ResizePhoto(original, largeSize)
+func (g *Generator) Resize(af *AlbumFile) error {
+	err := g.ResizePhoto(af.OriginalPath, af.Large, ProfileLarge)
 	if err != nil {
 		return err
 	}
 
-	smallSize := CalculateNewSizes(albumRoot, originalMeta, 320, 240, "small")
-
-	err = g.ResizePhoto(original, smallSize)
+	err = g.ResizePhoto(af.OriginalPath, af.Small, ProfileSmall)
 	if err != nil {
 		return err
 	}
@@ -650,12 +1042,32 @@ func (g *Generator) MarkDown(album *Album, path string, templateName string, ove
 func (g *Generator) GenerateAlbum(album *Album) error {
 	log.Printf("generating '%s' (%d files)", album.Config.Title, len(album.Files))
 
-	mdPath := filepath.Join(g.AlbumsRoot, fmt.Sprintf("%s.md", album.Config.PathName))
-	err := g.MarkDown(album, mdPath, "album.md.template", false)
+	if g.Config.Duplicates != nil {
+		err := g.FindDuplicates(album)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := g.Cover(album)
 	if err != nil {
 		return err
 	}
 
+	if g.Config.Collage != nil {
+		err = g.Collage(album)
+		if err != nil {
+			return err
+		}
+	}
+
+	if g.Config.Teaser != nil {
+		err = g.Teaser(album)
+		if err != nil {
+			return err
+		}
+	}
+
 	if false {
 		mdGalleryPath := filepath.Join(g.AlbumsRoot, fmt.Sprintf("%s.gallery.md", album.Config.PathName))
 		err = g.MarkDown(album, mdGalleryPath, "album.gallery.md.template", true)
@@ -664,12 +1076,6 @@ func (g *Generator) GenerateAlbum(album *Album) error {
 		}
 	}
 
-	jsonPath := filepath.Join(g.AlbumsRoot, fmt.Sprintf("%s.gallery.json", album.Config.PathName))
-	err = g.Json(album, jsonPath)
-	if err != nil {
-		return err
-	}
-
 	if true {
 		for _, af := range album.Files {
 			err = g.Thumbnails(g.AlbumsRoot, af.OriginalPath, ThumbnailSizes)
@@ -677,24 +1083,154 @@ func (g *Generator) GenerateAlbum(album *Album) error {
 				return err
 			}
 
-			err = g.Resize(g.AlbumsRoot, af.OriginalPath)
+			err = g.Resize(af)
+			if err != nil {
+				return err
+			}
+
+			af.Placeholder, err = g.Placeholder(af.OriginalPath)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
+	err = g.Manifest.Save()
+	if err != nil {
+		return err
+	}
+
+	// After the derivatives, whose sizes may have been corrected.
+	pages := g.Paginate(album)
+	for _, page := range pages {
+		err = g.WritePage(page)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = g.WritePageMap(album, pages)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// Generated values for the album's front matter. They go in extra,
+// where Zola allows them and the theme looks for its preview image,
+// along with links between the pages of paginated albums. Pages after
+// the first say which page they are in their title and point at the
+// first with page_of, so listings and feeds can leave them out.
+func (g *Generator) FrontMatter(album *Album) []FrontMatterValue {
+	var cover, social, collage, previous, next, pageOf, title string
+
+	if album.Cover != nil {
+		cover = g.SitePath(album.Cover.Cover.Path)
+		social = g.SitePath(album.Cover.Social.Path)
+	}
+	if album.Collage != nil {
+		collage = g.SitePath(album.Collage.Path)
+	}
+
+	// The theme's preview image, the collage when there is one.
+	thumbnail := social
+	if collage != "" {
+		thumbnail = collage
+	}
+
+	pageMarkDown := func(name string) string {
+		return g.SitePath(filepath.Join(g.AlbumsRoot, fmt.Sprintf("%s.md", name)))
+	}
+
+	if album.Page != nil && album.Page.Previous != "" {
+		previous = pageMarkDown(album.Page.Previous)
+	}
+	if album.Page != nil && album.Page.Next != "" {
+		next = pageMarkDown(album.Page.Next)
+	}
+
+	if album.Page != nil && album.Page.Number > 1 {
+		pageOf = pageMarkDown(album.Config.PathName)
+		title = fmt.Sprintf("%s (page %d of %d)", album.Config.Title, album.Page.Number, album.Page.Pages)
+	}
+
+	values := []FrontMatterValue{
+		{Key: "extra.cover", Value: cover},
+		{Key: "extra.social_image", Value: social},
+		{Key: "extra.collage", Value: collage},
+		{Key: "extra.static_thumbnail", Value: thumbnail},
+		{Key: "extra.previous", Value: previous},
+		{Key: "extra.next", Value: next},
+		{Key: "extra.page_of", Value: pageOf},
+	}
+
+	// An empty value would remove the title, the first page keeps the
+	// one it was written with.
+	if title != "" {
+		values = append(values, FrontMatterValue{Key: "title", Value: title})
+	}
+
+	return values
+}
+
+// Zola's content directory when the albums are inside one and the
+// albums root when they aren't, everything under it is published.
+func siteRoot(albumsRoot string) (string, error) {
+	root, err := filepath.Abs(albumsRoot)
+	if err != nil {
+		return "", err
+	}
+
+	for dir := root; filepath.Dir(dir) != dir; dir = filepath.Dir(dir) {
+		if filepath.Base(dir) == "content" {
+			return dir, nil
+		}
+	}
+
+	return root, nil
+}
+
+// Paths for the site, relative to its root.
+func (g *Generator) SitePath(path string) string {
+	root, err := siteRoot(g.AlbumsRoot)
+	if err != nil {
+		return path
+	}
+
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+
+	relative, err := filepath.Rel(root, absolute)
+	if err != nil {
+		return path
+	}
+
+	return filepath.ToSlash(relative)
+}
+
 type Options struct {
 	AlbumsRoot string
+	ReportPath string
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "contact-sheet" {
+		contactSheetCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "book" {
+		bookCommand(os.Args[2:])
+		return
+	}
+
 	o := &Options{}
 
 	flag.StringVar(&o.AlbumsRoot, "albums", "", "albums root directory")
+	flag.StringVar(&o.ReportPath, "report", "", "write a json run report here")
 
 	flag.Parse()
 
@@ -703,17 +1239,31 @@ func main() {
 		os.Exit(2)
 	}
 
-	g, err := NewGenerator("config.json", o.AlbumsRoot)
+	g, err := NewGenerator("config.json", o.AlbumsRoot, PublishMode)
 	if err != nil {
 		panic(err)
 	}
 
+	if g.Config.Stale != nil && g.Config.Stale.Fail && g.Report.HasStaleExports() {
+		g.Report.Log()
+		panic(fmt.Errorf("refusing to publish with %d stale and %d missing exports", len(g.Report.Stale), len(g.Report.Missing)))
+	}
+
 	for _, album := range g.Cache.AllAlbums {
 		err = g.GenerateAlbum(album)
 		if err != nil {
 			panic(err)
 		}
 	}
+
+	g.Report.Log()
+
+	if o.ReportPath != "" {
+		err = g.Report.Write(o.ReportPath)
+		if err != nil {
+			panic(err)
+		}
+	}
 }
 
 func removeAllExtensions(name string) string {
@@ -728,6 +1278,15 @@ func removeAllExtensions(name string) string {
 	}
 }
 
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
 func copyFile(s, d string) (int64, error) {
 	sfs, err := os.Stat(s)
 	if err != nil {
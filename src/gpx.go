@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type GpxConfig struct {
+	Path     string `json:"path"`
+	MaxGap   string `json:"max_gap"`
+	TimeZone string `json:"time_zone"`
+	Offset   string `json:"offset"`
+}
+
+type Location struct {
+	Latitude    float64
+	Longitude   float64
+	Altitude    float64
+	HasAltitude bool
+	Inferred    bool
+}
+
+type GpxFile struct {
+	Tracks []GpxTrack `xml:"trk"`
+}
+
+type GpxTrack struct {
+	Segments []GpxSegment `xml:"trkseg"`
+}
+
+type GpxSegment struct {
+	Points []GpxPoint `xml:"trkpt"`
+}
+
+type GpxPoint struct {
+	Latitude  float64  `xml:"lat,attr"`
+	Longitude float64  `xml:"lon,attr"`
+	Elevation *float64 `xml:"ele"`
+	Time      string   `xml:"time"`
+}
+
+type TrackPoint struct {
+	Time     time.Time
+	Location Location
+}
+
+type Track struct {
+	Points []TrackPoint
+}
+
+type Geotagger struct {
+	Track    *Track
+	MaxGap   time.Duration
+	Location *time.Location
+	Offset   time.Duration
+}
+
+func openGpx(path string) ([]TrackPoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	data, _ := ioutil.ReadAll(file)
+
+	gpxFile := &GpxFile{}
+	err = xml.Unmarshal(data, gpxFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	points := make([]TrackPoint, 0)
+
+	for _, track := range gpxFile.Tracks {
+		for _, segment := range track.Segments {
+			for _, p := range segment.Points {
+				if p.Time == "" {
+					continue
+				}
+
+				t, err := time.Parse(time.RFC3339, p.Time)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", path, err)
+				}
+
+				tp := TrackPoint{
+					Time: t,
+					Location: Location{
+						Latitude:  p.Latitude,
+						Longitude: p.Longitude,
+					},
+				}
+
+				if p.Elevation != nil {
+					tp.Location.Altitude = *p.Elevation
+					tp.Location.HasAltitude = true
+				}
+
+				points = append(points, tp)
+			}
+		}
+	}
+
+	return points, nil
+}
+
+// Loads a single GPX file or every GPX file below a directory into
+// one track, ordered by time.
+func loadTrack(path string) (*Track, error) {
+	track := &Track{
+		Points: make([]TrackPoint, 0),
+	}
+
+	err := filepath.Walk(path, func(path string, info os.FileInfo, e error) error {
+		if e != nil {
+			return e
+		}
+
+		if info.Mode().IsRegular() && strings.ToLower(filepath.Ext(info.Name())) == ".gpx" {
+			points, err := openGpx(path)
+			if err != nil {
+				return err
+			}
+
+			track.Points = append(track.Points, points...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(track.Points, func(i, j int) bool {
+		return track.Points[i].Time.Before(track.Points[j].Time)
+	})
+
+	log.Printf("loaded %d track points from %s", len(track.Points), path)
+
+	return track, nil
+}
+
+func (c *Cache) Geotagger(cfg *GpxConfig) (*Geotagger, error) {
+	if gt, ok := c.Geotaggers[cfg]; ok {
+		return gt, nil
+	}
+
+	track, ok := c.Tracks[cfg.Path]
+	if !ok {
+		loaded, err := loadTrack(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Tracks[cfg.Path] = loaded
+		track = loaded
+	}
+
+	gt := &Geotagger{
+		Track:    track,
+		MaxGap:   5 * time.Minute,
+		Location: time.Local,
+	}
+
+	if cfg.MaxGap != "" {
+		maxGap, err := time.ParseDuration(cfg.MaxGap)
+		if err != nil {
+			return nil, err
+		}
+		gt.MaxGap = maxGap
+	}
+
+	if cfg.TimeZone != "" {
+		location, err := time.LoadLocation(cfg.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+		gt.Location = location
+	}
+
+	if cfg.Offset != "" {
+		offset, err := time.ParseDuration(cfg.Offset)
+		if err != nil {
+			return nil, err
+		}
+		gt.Offset = offset
+	}
+
+	c.Geotaggers[cfg] = gt
+
+	return gt, nil
+}
+
+// Cameras record local wall clock time with no zone, and their
+// clocks drift, so this interprets the capture time in the configured
+// zone and applies the configured offset before comparing against
+// the track, which is always in UTC.
+func (gt *Geotagger) CorrectedTime(dateTimeOriginal string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", dateTimeOriginal, gt.Location)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.Add(gt.Offset), nil
+}
+
+func (gt *Geotagger) Locate(t time.Time) *Location {
+	points := gt.Track.Points
+	if len(points) == 0 {
+		return nil
+	}
+
+	i := sort.Search(len(points), func(i int) bool {
+		return !points[i].Time.Before(t)
+	})
+
+	if i < len(points) && points[i].Time.Equal(t) {
+		return inferred(points[i].Location)
+	}
+
+	if i > 0 && i < len(points) {
+		before := points[i-1]
+		after := points[i]
+		if after.Time.Sub(before.Time) <= gt.MaxGap {
+			f := float64(t.Sub(before.Time)) / float64(after.Time.Sub(before.Time))
+			l := Location{
+				Latitude:    before.Location.Latitude + (after.Location.Latitude-before.Location.Latitude)*f,
+				Longitude:   before.Location.Longitude + (after.Location.Longitude-before.Location.Longitude)*f,
+				HasAltitude: before.Location.HasAltitude && after.Location.HasAltitude,
+			}
+			if l.HasAltitude {
+				l.Altitude = before.Location.Altitude + (after.Location.Altitude-before.Location.Altitude)*f
+			}
+			return inferred(l)
+		}
+	}
+
+	// We're outside the track or in a gap too large to interpolate
+	// across, so fall back to the nearest point if it's close enough.
+	var nearest *TrackPoint
+	for _, j := range []int{i - 1, i} {
+		if j < 0 || j >= len(points) {
+			continue
+		}
+		if nearest == nil || absDuration(points[j].Time.Sub(t)) < absDuration(nearest.Time.Sub(t)) {
+			nearest = &points[j]
+		}
+	}
+
+	if nearest != nil && absDuration(nearest.Time.Sub(t)) <= gt.MaxGap {
+		return inferred(nearest.Location)
+	}
+
+	return nil
+}
+
+func inferred(l Location) *Location {
+	l.Inferred = true
+	return &l
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// Parses the XMP flavor of GPS coordinates, which look like
+// "48,51.5178N" or "48,51,30.12N".
+func parseXmpCoordinate(value string) (float64, error) {
+	value = strings.TrimSpace(value)
+	if len(value) < 2 {
+		return 0, fmt.Errorf("malformed coordinate: '%s'", value)
+	}
+
+	ref := strings.ToUpper(value[len(value)-1:])
+	parts := strings.Split(value[:len(value)-1], ",")
+
+	coordinate := 0.0
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, fmt.Errorf("malformed coordinate: '%s'", value)
+		}
+		coordinate += v / math.Pow(60, float64(i))
+	}
+
+	switch ref {
+	case "N", "E":
+	case "S", "W":
+		coordinate = -coordinate
+	default:
+		return 0, fmt.Errorf("malformed coordinate: '%s'", value)
+	}
+
+	return coordinate, nil
+}
+
+func xmpLocation(xmp *XmpFile) (*Location, error) {
+	d := xmp.Rdf.Description
+	if d.GPSLatitude == "" || d.GPSLongitude == "" {
+		return nil, nil
+	}
+
+	latitude, err := parseXmpCoordinate(d.GPSLatitude)
+	if err != nil {
+		return nil, err
+	}
+
+	longitude, err := parseXmpCoordinate(d.GPSLongitude)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Location{
+		Latitude:  latitude,
+		Longitude: longitude,
+	}
+
+	if d.GPSAltitude != "" {
+		altitude, err := parseRational(d.GPSAltitude)
+		if err != nil {
+			return nil, err
+		}
+		if d.GPSAltitudeRef == "1" {
+			altitude = -altitude
+		}
+		l.Altitude = altitude
+		l.HasAltitude = true
+	}
+
+	return l, nil
+}
+
+func parseRational(value string) (float64, error) {
+	parts := strings.Split(value, "/")
+	n, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	if len(parts) == 1 {
+		return n, nil
+	}
+	d, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	if d == 0 {
+		return 0, fmt.Errorf("malformed rational: '%s'", value)
+	}
+	return n / d, nil
+}
+
+// The track photos in an album are located against, the album's own
+// or the global one.
+func (g *Generator) TrackConfig(album *Album) *GpxConfig {
+	if album.Config.Gpx != nil {
+		return album.Config.Gpx
+	}
+	return g.Config.Gpx
+}
+
+// Where a track puts a photo, nil when the photo has no usable capture
+// time or the track doesn't reach it.
+func (g *Generator) TrackLocation(cfg *GpxConfig, xmpPath string, xmp *XmpFile) (*Location, error) {
+	if cfg == nil || xmp.Rdf.Description.DateTimeOriginal == "" {
+		return nil, nil
+	}
+
+	gt, err := g.Cache.Geotagger(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := gt.CorrectedTime(xmp.Rdf.Description.DateTimeOriginal)
+	if err != nil {
+		log.Printf("%s: %v, not geotagging", xmpPath, err)
+		return nil, nil
+	}
+
+	if !gt.Covers(t) {
+		return nil, nil
+	}
+
+	return gt.Locate(t), nil
+}
+
+// Whether the track could locate anything at t, before searching it.
+func (gt *Geotagger) Covers(t time.Time) bool {
+	points := gt.Track.Points
+	if len(points) == 0 {
+		return false
+	}
+	return !t.Before(points[0].Time.Add(-gt.MaxGap)) && !t.After(points[len(points)-1].Time.Add(gt.MaxGap))
+}
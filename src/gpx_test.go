@@ -0,0 +1,199 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseXmpCoordinate(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected float64
+		fails    bool
+	}{
+		{value: "48,51.5178N", expected: 48 + 51.5178/60},
+		{value: "48,51,30.12N", expected: 48 + 51.0/60 + 30.12/3600},
+		{value: "2,21.0W", expected: -(2 + 21.0/60)},
+		{value: "33,52.5S", expected: -(33 + 52.5/60)},
+		{value: " 151,12.5e ", expected: 151 + 12.5/60},
+		{value: "48,51.5178", fails: true},
+		{value: "48,north,N", fails: true},
+		{value: "N", fails: true},
+		{value: "", fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			actual, err := parseXmpCoordinate(test.value)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(actual-test.expected) > 1e-9 {
+				t.Fatalf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestGeotaggerLocate(t *testing.T) {
+	start := time.Date(2021, 7, 14, 10, 0, 0, 0, time.UTC)
+	at := func(minutes float64) time.Time {
+		return start.Add(time.Duration(minutes * float64(time.Minute)))
+	}
+
+	gt := &Geotagger{
+		MaxGap: 10 * time.Minute,
+		Track: &Track{Points: []TrackPoint{
+			{Time: at(0), Location: Location{Latitude: 48, Longitude: 2, Altitude: 100, HasAltitude: true}},
+			{Time: at(4), Location: Location{Latitude: 49, Longitude: 3, Altitude: 200, HasAltitude: true}},
+			{Time: at(8), Location: Location{Latitude: 50, Longitude: 4}},
+			{Time: at(60), Location: Location{Latitude: 51, Longitude: 5}},
+		}},
+	}
+
+	tests := []struct {
+		name     string
+		time     time.Time
+		expected *Location
+	}{
+		{"on a point", at(4), &Location{Latitude: 49, Longitude: 3, Altitude: 200, HasAltitude: true}},
+		{"between points", at(1), &Location{Latitude: 48.25, Longitude: 2.25, Altitude: 125, HasAltitude: true}},
+		{"altitude needs both ends", at(6), &Location{Latitude: 49.5, Longitude: 3.5}},
+		{"gap near its start", at(12), &Location{Latitude: 50, Longitude: 4}},
+		{"gap near its end", at(55), &Location{Latitude: 51, Longitude: 5}},
+		{"middle of a gap", at(34), nil},
+		{"shortly before", at(-5), &Location{Latitude: 48, Longitude: 2, Altitude: 100, HasAltitude: true}},
+		{"long before", at(-30), nil},
+		{"shortly after", at(65), &Location{Latitude: 51, Longitude: 5}},
+		{"long after", at(90), nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := gt.Locate(test.time)
+			if test.expected == nil {
+				if actual != nil {
+					t.Fatalf("expected nothing, got %+v", actual)
+				}
+				return
+			}
+			if actual == nil {
+				t.Fatalf("expected %+v, got nothing", test.expected)
+			}
+			if !actual.Inferred {
+				t.Errorf("track locations should be inferred")
+			}
+			if math.Abs(actual.Latitude-test.expected.Latitude) > 1e-9 ||
+				math.Abs(actual.Longitude-test.expected.Longitude) > 1e-9 ||
+				actual.HasAltitude != test.expected.HasAltitude ||
+				math.Abs(actual.Altitude-test.expected.Altitude) > 1e-9 {
+				t.Fatalf("expected %+v, got %+v", test.expected, actual)
+			}
+		})
+	}
+
+	if (&Geotagger{Track: &Track{}}).Locate(start) != nil {
+		t.Errorf("an empty track shouldn't locate anything")
+	}
+}
+
+func TestGeotaggerCovers(t *testing.T) {
+	start := time.Date(2021, 7, 14, 10, 0, 0, 0, time.UTC)
+	gt := &Geotagger{
+		MaxGap: 5 * time.Minute,
+		Track: &Track{Points: []TrackPoint{
+			{Time: start},
+			{Time: start.Add(time.Hour)},
+		}},
+	}
+
+	tests := []struct {
+		name     string
+		time     time.Time
+		expected bool
+	}{
+		{"first point", start, true},
+		{"within", start.Add(30 * time.Minute), true},
+		{"just before", start.Add(-5 * time.Minute), true},
+		{"too early", start.Add(-6 * time.Minute), false},
+		{"just after", start.Add(65 * time.Minute), true},
+		{"too late", start.Add(66 * time.Minute), false},
+	}
+
+	for _, test := range tests {
+		if actual := gt.Covers(test.time); actual != test.expected {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.expected, actual)
+		}
+	}
+
+	if (&Geotagger{Track: &Track{}}).Covers(start) {
+		t.Errorf("an empty track shouldn't cover anything")
+	}
+}
+
+// A bad GPS value falls back to the track rather than stopping the run.
+func TestMatchAlbumsMalformedGps(t *testing.T) {
+	cfg := &GpxConfig{Path: "track.gpx"}
+	start := time.Date(2021, 7, 14, 10, 0, 0, 0, time.UTC)
+
+	g := &Generator{
+		Config: &Configuration{},
+		Cache: &Cache{
+			AllAlbums: []*Album{{Config: &AlbumConfig{Title: "Trip", Tags: []string{"trip"}, Gpx: cfg}}},
+			Geotaggers: map[*GpxConfig]*Geotagger{cfg: {
+				MaxGap:   5 * time.Minute,
+				Location: time.UTC,
+				Track:    &Track{Points: []TrackPoint{{Time: start, Location: Location{Latitude: 48, Longitude: 2}}}},
+			}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		latitude string
+		date     string
+		expected *Location
+	}{
+		{"malformed uses the track", "48,north,N", "2021:07:14 10:01:00", &Location{Latitude: 48, Longitude: 2, Inferred: true}},
+		{"malformed outside the track", "48,north,N", "2021:07:15 10:00:00", nil},
+		{"malformed without a date", "48,north,N", "", nil},
+		{"bad date", "", "yesterday", nil},
+		{"native wins", "10,30N", "2021:07:14 10:01:00", &Location{Latitude: 10.5, Longitude: 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			xmp := &XmpFile{}
+			d := &xmp.Rdf.Description
+			d.GPSLatitude, d.GPSLongitude = test.latitude, "1,0E"
+			d.DateTimeOriginal = test.date
+			d.HierarchicalSubjects.Subjects = []string{"trip"}
+
+			matches, err := g.MatchAlbums("photo.xmp", xmp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(matches) != 1 {
+				t.Fatalf("expected a match, got %d", len(matches))
+			}
+
+			actual := matches[0].Location
+			if test.expected == nil || actual == nil {
+				if test.expected != actual {
+					t.Fatalf("expected %+v, got %+v", test.expected, actual)
+				}
+				return
+			}
+			if *actual != *test.expected {
+				t.Fatalf("expected %+v, got %+v", test.expected, actual)
+			}
+		})
+	}
+}
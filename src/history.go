@@ -0,0 +1,226 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type EditModule struct {
+	Operation string
+	Name      string
+	Instance  string
+}
+
+type EditSummary struct {
+	Modules              []*EditModule
+	Cropped              bool
+	PerspectiveCorrected bool
+	LensCorrected        bool
+	Monochrome           bool
+	Denoised             bool
+	Retouched            bool
+}
+
+// Names as they appear in darktable's darkroom, keyed by operation.
+var moduleNames = map[string]string{
+	"ashift":           "rotate and perspective",
+	"atrous":           "contrast equalizer",
+	"basecurve":        "base curve",
+	"basicadj":         "basic adjustments",
+	"bilat":            "local contrast",
+	"bilateral":        "surface blur",
+	"bloom":            "bloom",
+	"blurs":            "blurs",
+	"borders":          "framing",
+	"cacorrect":        "chromatic aberrations",
+	"cacorrectrgb":     "chromatic aberrations",
+	"censorize":        "censorize",
+	"channelmixer":     "channel mixer",
+	"channelmixerrgb":  "color calibration",
+	"clipping":         "crop and rotate",
+	"colorbalance":     "color balance",
+	"colorbalancergb":  "color balance rgb",
+	"colorchecker":     "color look up table",
+	"colorcontrast":    "color contrast",
+	"colorcorrection":  "color correction",
+	"colorize":         "colorize",
+	"colormapping":     "color mapping",
+	"colorreconstruct": "color reconstruction",
+	"colorzones":       "color zones",
+	"crop":             "crop",
+	"defringe":         "defringe",
+	"denoiseprofile":   "denoise (profiled)",
+	"diffuse":          "diffuse or sharpen",
+	"enlargecanvas":    "enlarge canvas",
+	"exposure":         "exposure",
+	"filmic":           "filmic",
+	"filmicrgb":        "filmic rgb",
+	"flip":             "orientation",
+	"globaltonemap":    "global tonemap",
+	"graduatednd":      "graduated density",
+	"grain":            "grain",
+	"hazeremoval":      "haze removal",
+	"highlights":       "highlight reconstruction",
+	"highpass":         "highpass",
+	"hotpixels":        "hot pixels",
+	"invert":           "invert",
+	"lens":             "lens correction",
+	"levels":           "levels",
+	"liquify":          "liquify",
+	"localcontrast":    "local contrast",
+	"lowlight":         "lowlight vision",
+	"lowpass":          "lowpass",
+	"lut3d":            "lut 3D",
+	"monochrome":       "monochrome",
+	"negadoctor":       "negadoctor",
+	"nlmeans":          "astrophoto denoise",
+	"overlay":          "composite",
+	"relight":          "fill light",
+	"retouch":          "retouch",
+	"rgbcurve":         "rgb curve",
+	"rgblevels":        "rgb levels",
+	"rotatepixels":     "rotate pixels",
+	"scalepixels":      "scale pixels",
+	"shadhi":           "shadows and highlights",
+	"sharpen":          "sharpen",
+	"sigmoid":          "sigmoid",
+	"soften":           "soften",
+	"splittoning":      "split-toning",
+	"spots":            "spot removal",
+	"temperature":      "white balance",
+	"tonecurve":        "tone curve",
+	"toneequal":        "tone equalizer",
+	"tonemap":          "tone mapping",
+	"velvia":           "velvia",
+	"vibrance":         "vibrance",
+	"vignette":         "vignetting",
+	"watermark":        "watermark",
+	"zonesystem":       "zone system",
+}
+
+// Plumbing that's enabled in every pipeline and says nothing about
+// how a photo was edited.
+var pipelineModules = map[string]bool{
+	"colorin":      true,
+	"colorout":     true,
+	"demosaic":     true,
+	"dither":       true,
+	"finalscale":   true,
+	"gamma":        true,
+	"mask_manager": true,
+	"rawprepare":   true,
+}
+
+type moduleInstance struct {
+	Operation string
+	Priority  int64
+}
+
+// Newer versions of darktable write the pipeline order once, as a
+// comma separated list of operation and instance priority pairs.
+func parseIopOrderList(value string) map[moduleInstance]int {
+	order := make(map[moduleInstance]int)
+	fields := strings.Split(value, ",")
+	for i := 0; i+1 < len(fields); i += 2 {
+		priority, err := strconv.ParseInt(strings.TrimSpace(fields[i+1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		order[moduleInstance{Operation: strings.TrimSpace(fields[i]), Priority: priority}] = i / 2
+	}
+	return order
+}
+
+// Returns the state of every module instance in the history, enabled
+// or not.
+func latestHistory(d *RdfDescription) map[moduleInstance]DarkTableHistory {
+	// Entries past history_end were undone in the darkroom, all of
+	// them when it's 0. Older side cars don't have the attribute and
+	// everything applies.
+	end := int64(len(d.History))
+	if d.HistoryEnd != nil {
+		end = *d.HistoryEnd
+	}
+
+	// Later entries for the same module instance replace earlier ones.
+	latest := make(map[moduleInstance]DarkTableHistory)
+	for _, h := range d.History {
+		if h.Number >= end {
+			continue
+		}
+		latest[moduleInstance{Operation: h.Operation, Priority: h.MultiPriority}] = h
+	}
+
+	return latest
+}
+
+func summarizeEdits(xmp *XmpFile) *EditSummary {
+	d := xmp.Rdf.Description
+	if len(d.History) == 0 {
+		return nil
+	}
+
+	latest := latestHistory(&d)
+
+	listed := parseIopOrderList(d.IopOrderList)
+
+	enabled := make([]DarkTableHistory, 0)
+	for _, h := range latest {
+		if h.Enabled != 0 && !pipelineModules[h.Operation] {
+			enabled = append(enabled, h)
+		}
+	}
+
+	position := func(h DarkTableHistory) float64 {
+		if i, ok := listed[moduleInstance{Operation: h.Operation, Priority: h.MultiPriority}]; ok {
+			return float64(i)
+		}
+		if f, err := strconv.ParseFloat(h.IopOrder, 64); err == nil {
+			return f
+		}
+		return float64(h.Number)
+	}
+
+	sort.SliceStable(enabled, func(i, j int) bool {
+		pi, pj := position(enabled[i]), position(enabled[j])
+		if pi != pj {
+			return pi < pj
+		}
+		return enabled[i].Number < enabled[j].Number
+	})
+
+	summary := &EditSummary{
+		Modules: make([]*EditModule, 0, len(enabled)),
+	}
+
+	for _, h := range enabled {
+		name, ok := moduleNames[h.Operation]
+		if !ok {
+			name = h.Operation
+		}
+
+		summary.Modules = append(summary.Modules, &EditModule{
+			Operation: h.Operation,
+			Name:      name,
+			Instance:  h.MultiName,
+		})
+
+		switch h.Operation {
+		case "crop", "clipping":
+			summary.Cropped = true
+		case "ashift":
+			summary.PerspectiveCorrected = true
+		case "lens", "cacorrect", "cacorrectrgb":
+			summary.LensCorrected = true
+		case "monochrome":
+			summary.Monochrome = true
+		case "denoiseprofile", "nlmeans", "bilateral":
+			summary.Denoised = true
+		case "retouch", "spots", "liquify":
+			summary.Retouched = true
+		}
+	}
+
+	return summary
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const historyXmp = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:darktable="http://darktable.sf.net/"
+    xmp:Rating="4" %s>
+   <darktable:history>
+    <rdf:Seq>
+     <rdf:li darktable:num="0" darktable:operation="exposure" darktable:enabled="1" darktable:params="00ff" darktable:multi_priority="0"/>
+     <rdf:li darktable:num="1" darktable:operation="crop" darktable:enabled="1" darktable:params="00ff" darktable:multi_priority="0"/>
+     <rdf:li darktable:num="2" darktable:operation="exposure" darktable:enabled="0" darktable:params="00ff" darktable:multi_priority="0"/>
+     <rdf:li darktable:num="3" darktable:operation="exposure" darktable:enabled="1" darktable:params="00ff" darktable:multi_priority="1" darktable:multi_name="shadows"/>
+    </rdf:Seq>
+   </darktable:history>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+
+func parseHistoryXmp(t *testing.T, attributes string) *XmpFile {
+	t.Helper()
+
+	xmp := &XmpFile{}
+	err := xml.Unmarshal([]byte(strings.Replace(historyXmp, "%s", attributes, 1)), xmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return xmp
+}
+
+func TestLatestHistory(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes string
+		expected   []string
+	}{
+		{"no history_end applies everything", "", []string{"crop 0", "exposure 1"}},
+		{"everything", `darktable:history_end="4"`, []string{"crop 0", "exposure 1"}},
+		{"before the exposure was turned off", `darktable:history_end="2"`, []string{"crop 0", "exposure 0"}},
+		{"only the first entry", `darktable:history_end="1"`, []string{"exposure 0"}},
+		{"every edit undone", `darktable:history_end="0"`, []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			xmp := parseHistoryXmp(t, test.attributes)
+
+			enabled := make([]string, 0)
+			for instance, h := range latestHistory(&xmp.Rdf.Description) {
+				if h.Enabled == 0 {
+					continue
+				}
+				enabled = append(enabled, fmt.Sprintf("%s %d", instance.Operation, instance.Priority))
+			}
+			sort.Strings(enabled)
+
+			if !reflect.DeepEqual(enabled, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, enabled)
+			}
+		})
+	}
+}
+
+func TestXmpJsonLeavesOutHistory(t *testing.T) {
+	data, err := json.Marshal(parseHistoryXmp(t, `darktable:history_end="0"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{`"Rating":4`, `"HistoryEnd":0`} {
+		if !strings.Contains(string(data), expected) {
+			t.Fatalf("expected %s in %s", expected, data)
+		}
+	}
+	if strings.Contains(string(data), "00ff") {
+		t.Fatalf("history params in %s", data)
+	}
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// IccProfile is an embedded color profile. We only understand enough
+// of the format to name a profile and to convert from matrix/TRC
+// profiles, which is what cameras and editors write for RGB and gray.
+type IccProfile struct {
+	Data        []byte
+	ColorSpace  string
+	Description string
+
+	matrix   *[3][3]float64
+	curves   [3]*toneCurve
+	gray     *toneCurve
+	parseErr error
+}
+
+type toneCurve struct {
+	gamma  float64
+	table  []float64
+	params []float64
+	kind   int
+}
+
+const (
+	curveGamma = iota
+	curveTable
+	curveParametric
+)
+
+// The sRGB primaries adapted to D50, the ICC connection space.
+var srgbD50 = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+const iccJpegMarker = "ICC_PROFILE\x00"
+
+// Finds the ICC profile embedded in a JPEG, PNG or TIFF, returning
+// nil when there isn't one.
+func extractIcc(data []byte) (*IccProfile, error) {
+	var raw []byte
+	var err error
+
+	switch {
+	case len(data) > 2 && data[0] == 0xff && data[1] == 0xd8:
+		raw, err = jpegIcc(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		raw, err = pngIcc(data)
+	case bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*")):
+		raw, err = tiffIcc(data)
+	}
+	if err != nil || raw == nil {
+		return nil, err
+	}
+
+	return parseIcc(raw), nil
+}
+
+func jpegIcc(data []byte) ([]byte, error) {
+	chunks := make(map[int][]byte)
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return nil, fmt.Errorf("malformed jpeg marker at %d", i)
+		}
+		marker := data[i+1]
+		if marker == 0xd8 || (marker >= 0xd0 && marker <= 0xd7) || marker == 0xff {
+			i += 2
+			continue
+		}
+		// Start of scan, the headers are over.
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, fmt.Errorf("malformed jpeg segment at %d", i)
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xe2 && len(segment) > len(iccJpegMarker)+2 && string(segment[:len(iccJpegMarker)]) == iccJpegMarker {
+			sequence := int(segment[len(iccJpegMarker)])
+			chunks[sequence] = segment[len(iccJpegMarker)+2:]
+		}
+		i += 2 + length
+	}
+
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+
+	sequences := make([]int, 0, len(chunks))
+	for sequence := range chunks {
+		sequences = append(sequences, sequence)
+	}
+	sort.Ints(sequences)
+
+	raw := make([]byte, 0)
+	for _, sequence := range sequences {
+		raw = append(raw, chunks[sequence]...)
+	}
+
+	return raw, nil
+}
+
+func pngIcc(data []byte) ([]byte, error) {
+	i := 8
+	for i+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		kind := string(data[i+4 : i+8])
+		if i+12+length > len(data) {
+			return nil, fmt.Errorf("malformed png chunk at %d", i)
+		}
+		chunk := data[i+8 : i+8+length]
+		switch kind {
+		case "iCCP":
+			// Profile name, a null, the compression method and then
+			// the zlib compressed profile.
+			nul := bytes.IndexByte(chunk, 0)
+			if nul < 0 || nul+2 > len(chunk) {
+				return nil, fmt.Errorf("malformed iCCP chunk")
+			}
+			reader, err := zlib.NewReader(bytes.NewReader(chunk[nul+2:]))
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return ioutil.ReadAll(reader)
+		case "IDAT", "IEND":
+			return nil, nil
+		}
+		i += 12 + length
+	}
+	return nil, nil
+}
+
+const tiffIccTag = 34675
+
+func tiffIcc(data []byte) ([]byte, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		order = binary.BigEndian
+	}
+
+	if len(data) < 8 {
+		return nil, fmt.Errorf("malformed tiff")
+	}
+
+	ifd := int(order.Uint32(data[4:]))
+	if ifd+2 > len(data) {
+		return nil, fmt.Errorf("malformed tiff ifd")
+	}
+
+	entries := int(order.Uint16(data[ifd:]))
+	for e := 0; e < entries; e++ {
+		entry := ifd + 2 + e*12
+		if entry+12 > len(data) {
+			return nil, fmt.Errorf("malformed tiff ifd entry")
+		}
+		if order.Uint16(data[entry:]) != tiffIccTag {
+			continue
+		}
+		count := int(order.Uint32(data[entry+4:]))
+		offset := int(order.Uint32(data[entry+8:]))
+		if count <= 4 {
+			return data[entry+8 : entry+8+count], nil
+		}
+		if offset+count > len(data) {
+			return nil, fmt.Errorf("malformed tiff icc profile")
+		}
+		return data[offset : offset+count], nil
+	}
+
+	return nil, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func parseIcc(raw []byte) *IccProfile {
+	p := &IccProfile{Data: raw}
+
+	if len(raw) < 132 {
+		p.parseErr = fmt.Errorf("short icc profile")
+		return p
+	}
+
+	p.ColorSpace = strings.TrimSpace(string(raw[16:20]))
+
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(raw[128:]))
+	for t := 0; t < count; t++ {
+		entry := 132 + t*12
+		if entry+12 > len(raw) {
+			p.parseErr = fmt.Errorf("malformed icc tag table")
+			return p
+		}
+		signature := string(raw[entry : entry+4])
+		offset := int(binary.BigEndian.Uint32(raw[entry+4:]))
+		size := int(binary.BigEndian.Uint32(raw[entry+8:]))
+		if offset+size > len(raw) || size < 8 {
+			continue
+		}
+		tags[signature] = raw[offset : offset+size]
+	}
+
+	p.Description = iccText(tags["desc"])
+
+	if p.ColorSpace == "GRAY" {
+		p.gray, p.parseErr = parseCurve(tags["kTRC"])
+		return p
+	}
+
+	if p.ColorSpace != "RGB" {
+		p.parseErr = fmt.Errorf("unsupported color space '%s'", p.ColorSpace)
+		return p
+	}
+
+	matrix := [3][3]float64{}
+	for column, signature := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		tag := tags[signature]
+		if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+			p.parseErr = fmt.Errorf("missing or unsupported %s", signature)
+			return p
+		}
+		for row := 0; row < 3; row++ {
+			matrix[row][column] = s15Fixed16(tag[8+row*4:])
+		}
+	}
+	p.matrix = &matrix
+
+	for channel, signature := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := parseCurve(tags[signature])
+		if err != nil {
+			p.parseErr = err
+			return p
+		}
+		p.curves[channel] = curve
+	}
+
+	return p
+}
+
+func iccText(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+
+	switch string(tag[:4]) {
+	case "desc":
+		length := int(binary.BigEndian.Uint32(tag[8:]))
+		if 12+length > len(tag) {
+			return ""
+		}
+		return strings.TrimRight(string(tag[12:12+length]), "\x00")
+	case "mluc":
+		records := int(binary.BigEndian.Uint32(tag[8:]))
+		if records == 0 || len(tag) < 28 {
+			return ""
+		}
+		length := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if offset+length > len(tag) {
+			return ""
+		}
+		units := make([]uint16, length/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[offset+i*2:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	case "text":
+		return strings.TrimRight(string(tag[8:]), "\x00")
+	}
+
+	return ""
+}
+
+func parseCurve(tag []byte) (*toneCurve, error) {
+	if len(tag) < 12 {
+		return nil, fmt.Errorf("missing tone curve")
+	}
+
+	switch string(tag[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:]))
+		if count == 0 {
+			return &toneCurve{kind: curveGamma, gamma: 1}, nil
+		}
+		if count == 1 && len(tag) >= 14 {
+			return &toneCurve{kind: curveGamma, gamma: float64(binary.BigEndian.Uint16(tag[12:])) / 256}, nil
+		}
+		if 12+count*2 > len(tag) {
+			return nil, fmt.Errorf("malformed curv")
+		}
+		table := make([]float64, count)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+i*2:])) / 65535
+		}
+		return &toneCurve{kind: curveTable, table: table}, nil
+	case "para":
+		function := int(binary.BigEndian.Uint16(tag[8:]))
+		counts := []int{1, 3, 4, 5, 7}
+		if function >= len(counts) || 12+counts[function]*4 > len(tag) {
+			return nil, fmt.Errorf("unsupported parametric curve %d", function)
+		}
+		params := make([]float64, 7)
+		for i := 0; i < counts[function]; i++ {
+			params[i] = s15Fixed16(tag[12+i*4:])
+		}
+		return &toneCurve{kind: curveParametric, params: params, gamma: float64(function)}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported tone curve '%s'", string(tag[:4]))
+}
+
+// Maps an encoded value in [0, 1] to linear light.
+func (c *toneCurve) apply(x float64) float64 {
+	switch c.kind {
+	case curveGamma:
+		return math.Pow(x, c.gamma)
+	case curveTable:
+		position := x * float64(len(c.table)-1)
+		i := int(position)
+		if i >= len(c.table)-1 {
+			return c.table[len(c.table)-1]
+		}
+		f := position - float64(i)
+		return c.table[i]*(1-f) + c.table[i+1]*f
+	}
+
+	g, a, b, cc, d, e, f := c.params[0], c.params[1], c.params[2], c.params[3], c.params[4], c.params[5], c.params[6]
+	switch int(c.gamma) {
+	case 0:
+		return math.Pow(x, g)
+	case 1:
+		if x >= -b/a {
+			return math.Pow(a*x+b, g)
+		}
+		return 0
+	case 2:
+		if x >= -b/a {
+			return math.Pow(a*x+b, g) + cc
+		}
+		return cc
+	case 3:
+		if x >= d {
+			return math.Pow(a*x+b, g)
+		}
+		return cc * x
+	default:
+		if x >= d {
+			return math.Pow(a*x+b, g) + e
+		}
+		return cc*x + f
+	}
+}
+
+func (p *IccProfile) CanConvert() bool {
+	return p.parseErr == nil && (p.matrix != nil || p.gray != nil)
+}
+
+// Close enough to sRGB that converting would only add rounding error.
+func (p *IccProfile) IsSRGB() bool {
+	if strings.Contains(strings.ToLower(p.Description), "srgb") {
+		return true
+	}
+	if p.matrix == nil {
+		return false
+	}
+	for row := 0; row < 3; row++ {
+		for column := 0; column < 3; column++ {
+			if math.Abs(p.matrix[row][column]-srgbD50[row][column]) > 0.002 {
+				return false
+			}
+		}
+	}
+	for _, curve := range p.curves {
+		for _, x := range []float64{0.05, 0.25, 0.5, 0.75} {
+			if math.Abs(curve.apply(x)-srgbToLinear(x)) > 0.005 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func srgbToLinear(x float64) float64 {
+	if x <= 0.04045 {
+		return x / 12.92
+	}
+	return math.Pow((x+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(x float64) float64 {
+	if x <= 0.0031308 {
+		return x * 12.92
+	}
+	return 1.055*math.Pow(x, 1/2.4) - 0.055
+}
+
+func invert3(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	inv := [3][3]float64{}
+	inv[0][0] = (m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det
+	inv[0][1] = (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det
+	inv[0][2] = (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det
+	inv[1][0] = (m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det
+	inv[1][1] = (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det
+	inv[1][2] = (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det
+	inv[2][0] = (m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det
+	inv[2][1] = (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det
+	inv[2][2] = (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det
+	return inv
+}
+
+func multiply3(a, b [3][3]float64) [3][3]float64 {
+	m := [3][3]float64{}
+	for row := 0; row < 3; row++ {
+		for column := 0; column < 3; column++ {
+			for k := 0; k < 3; k++ {
+				m[row][column] += a[row][k] * b[k][column]
+			}
+		}
+	}
+	return m
+}
+
+const srgbTableSize = 4096
+
+func srgbEncodingTable() []uint8 {
+	table := make([]uint8, srgbTableSize+1)
+	for i := range table {
+		table[i] = uint8(math.Round(linearToSrgb(float64(i)/srgbTableSize) * 255))
+	}
+	return table
+}
+
+func encodeSrgb(table []uint8, linear float64) uint8 {
+	if linear <= 0 {
+		return 0
+	}
+	if linear >= 1 {
+		return 255
+	}
+	return table[int(linear*srgbTableSize+0.5)]
+}
+
+// Converts 8 bit pixels described by this profile into sRGB, going
+// through linear light and the D50 connection space.
+func (p *IccProfile) ConvertToSRGB(i image.Image) (image.Image, error) {
+	if !p.CanConvert() {
+		return nil, fmt.Errorf("unable to convert from '%s': %v", p.Description, p.parseErr)
+	}
+
+	output := srgbEncodingTable()
+	bounds := i.Bounds()
+
+	if p.gray != nil {
+		gray := image.NewGray(bounds)
+		draw.Draw(gray, bounds, i, bounds.Min, draw.Src)
+		lookup := [256]uint8{}
+		for v := range lookup {
+			lookup[v] = encodeSrgb(output, p.gray.apply(float64(v)/255))
+		}
+		for j, v := range gray.Pix {
+			gray.Pix[j] = lookup[v]
+		}
+		return gray, nil
+	}
+
+	m := multiply3(invert3(srgbD50), *p.matrix)
+
+	linear := [3][256]float64{}
+	for channel := 0; channel < 3; channel++ {
+		for v := 0; v < 256; v++ {
+			linear[channel][v] = p.curves[channel].apply(float64(v) / 255)
+		}
+	}
+
+	rgba := image.NewRGBA(bounds)
+	draw.Draw(rgba, bounds, i, bounds.Min, draw.Src)
+
+	for j := 0; j+3 < len(rgba.Pix); j += 4 {
+		r := linear[0][rgba.Pix[j]]
+		g := linear[1][rgba.Pix[j+1]]
+		b := linear[2][rgba.Pix[j+2]]
+		rgba.Pix[j] = encodeSrgb(output, m[0][0]*r+m[0][1]*g+m[0][2]*b)
+		rgba.Pix[j+1] = encodeSrgb(output, m[1][0]*r+m[1][1]*g+m[1][2]*b)
+		rgba.Pix[j+2] = encodeSrgb(output, m[2][0]*r+m[2][1]*g+m[2][2]*b)
+	}
+
+	return rgba, nil
+}
+
+// Splits the profile into the APP2 segments JPEG uses to carry it,
+// numbered so readers can put it back together.
+func (p *IccProfile) JpegSegments() ([][]byte, error) {
+	const maximum = jpegMaximumPayload - len(iccJpegMarker) - 2
+
+	count := (len(p.Data) + maximum - 1) / maximum
+	if count > 255 {
+		return nil, fmt.Errorf("profile '%s' is too large to embed (%d bytes)", p.Description, len(p.Data))
+	}
+
+	segments := make([][]byte, 0, count)
+	for n := 0; n < count; n++ {
+		start := n * maximum
+		end := start + maximum
+		if end > len(p.Data) {
+			end = len(p.Data)
+		}
+		payload := append([]byte(iccJpegMarker), byte(n+1), byte(count))
+		payload = append(payload, p.Data[start:end]...)
+		segment, err := jpegSegment(0xe2, payload)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// A segment's length includes its two bytes.
+const jpegMaximumPayload = 65535 - 2
+
+func jpegSegment(marker byte, payload []byte) ([]byte, error) {
+	if len(payload) > jpegMaximumPayload {
+		return nil, fmt.Errorf("%d bytes is too much for a jpeg segment", len(payload))
+	}
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...), nil
+}
+
+// Whether a profile describes pixels like these, an RGB profile on a
+// grayscale derivative or a CMYK profile on anything we write would
+// be wrong.
+func (p *IccProfile) Describes(i image.Image) bool {
+	if _, ok := i.(*image.Gray); ok {
+		return p.ColorSpace == "GRAY"
+	}
+	return p.ColorSpace == "RGB"
+}
+
+// Applies a profile's color policy to a derivative, returning the
+// pixels to encode and any segments to embed.
+func manageColor(i image.Image, source *IccProfile, policy string) (image.Image, [][]byte, *ColorRecord) {
+	record := &ColorRecord{
+		Policy:  policy,
+		Applied: "none",
+	}
+
+	if source == nil {
+		return i, nil, record
+	}
+
+	record.SourceProfile = source.Description
+
+	if policy == ColorNone {
+		return i, nil, record
+	}
+
+	if !source.Describes(i) {
+		log.Printf("dropping %s profile '%s'", source.ColorSpace, source.Description)
+		record.Applied = "dropped"
+		return i, nil, record
+	}
+
+	if policy == ColorConvert {
+		if source.IsSRGB() {
+			return i, nil, record
+		}
+
+		converted, err := source.ConvertToSRGB(i)
+		if err == nil {
+			record.Applied = "converted"
+			return converted, nil, record
+		}
+
+		// Better to keep the colors right in browsers that manage
+		// color than to get them wrong everywhere.
+		log.Printf("embedding instead: %v", err)
+	}
+
+	segments, err := source.JpegSegments()
+	if err != nil {
+		log.Printf("dropping: %v", err)
+		record.Applied = "dropped"
+		return i, nil, record
+	}
+
+	record.Applied = "embedded"
+	return i, segments, record
+}
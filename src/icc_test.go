@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+	"unicode/utf16"
+)
+
+type iccTag struct {
+	Signature string
+	Data      []byte
+}
+
+// Builds a profile with just the header fields and tags we read.
+func syntheticIcc(colorSpace string, tags ...iccTag) []byte {
+	header := make([]byte, 128)
+	copy(header[16:], colorSpace+"    ")
+	copy(header[36:], "acsp")
+
+	table := make([]byte, 4+12*len(tags))
+	binary.BigEndian.PutUint32(table, uint32(len(tags)))
+
+	data := make([]byte, 0)
+	offset := len(header) + len(table)
+	for n, tag := range tags {
+		entry := table[4+n*12:]
+		copy(entry, tag.Signature)
+		binary.BigEndian.PutUint32(entry[4:], uint32(offset+len(data)))
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(tag.Data)))
+		data = append(data, tag.Data...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+
+	profile := append(append(header, table...), data...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+func s15Fixed16Bytes(values ...float64) []byte {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(data[i*4:], uint32(int32(math.Round(v*65536))))
+	}
+	return data
+}
+
+func xyzTag(signature string, x, y, z float64) iccTag {
+	return iccTag{signature, append([]byte("XYZ \x00\x00\x00\x00"), s15Fixed16Bytes(x, y, z)...)}
+}
+
+func gammaTag(signature string, gamma float64) iccTag {
+	data := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00")
+	binary.BigEndian.PutUint16(data[12:], uint16(math.Round(gamma*256)))
+	return iccTag{signature, data}
+}
+
+func tableTag(signature string, values ...uint16) iccTag {
+	data := make([]byte, 12+2*len(values))
+	copy(data, "curv")
+	binary.BigEndian.PutUint32(data[8:], uint32(len(values)))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(data[12+i*2:], v)
+	}
+	return iccTag{signature, data}
+}
+
+func parametricTag(signature string, function uint16, params ...float64) iccTag {
+	data := make([]byte, 12)
+	copy(data, "para")
+	binary.BigEndian.PutUint16(data[8:], function)
+	return iccTag{signature, append(data, s15Fixed16Bytes(params...)...)}
+}
+
+func descTag(text string) iccTag {
+	data := make([]byte, 12)
+	copy(data, "desc")
+	binary.BigEndian.PutUint32(data[8:], uint32(len(text)+1))
+	return iccTag{"desc", append(append(data, text...), 0)}
+}
+
+func mlucTag(text string) iccTag {
+	units := utf16.Encode([]rune(text))
+	data := make([]byte, 28+2*len(units))
+	copy(data, "mluc")
+	binary.BigEndian.PutUint32(data[8:], 1)
+	binary.BigEndian.PutUint32(data[12:], 12)
+	copy(data[16:], "enUS")
+	binary.BigEndian.PutUint32(data[20:], uint32(2*len(units)))
+	binary.BigEndian.PutUint32(data[24:], 28)
+	for i, u := range units {
+		binary.BigEndian.PutUint16(data[28+i*2:], u)
+	}
+	return iccTag{"desc", data}
+}
+
+func rgbIcc(description iccTag, primaries [3][3]float64, curve func(signature string) iccTag) []byte {
+	return syntheticIcc("RGB",
+		description,
+		xyzTag("rXYZ", primaries[0][0], primaries[1][0], primaries[2][0]),
+		xyzTag("gXYZ", primaries[0][1], primaries[1][1], primaries[2][1]),
+		xyzTag("bXYZ", primaries[0][2], primaries[1][2], primaries[2][2]),
+		curve("rTRC"), curve("gTRC"), curve("bTRC"),
+	)
+}
+
+// Adobe RGB (1998) adapted to D50.
+var adobeD50 = [3][3]float64{
+	{0.6097559, 0.2052401, 0.1492240},
+	{0.3111242, 0.6256560, 0.0632197},
+	{0.0194811, 0.0608902, 0.7448387},
+}
+
+func srgbCurve(signature string) iccTag {
+	return parametricTag(signature, 3, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045)
+}
+
+func adobeCurve(signature string) iccTag {
+	return gammaTag(signature, 2.2)
+}
+
+func linearTableCurve(signature string) iccTag {
+	return tableTag(signature, 0, 32768, 65535)
+}
+
+func TestJpegSegment(t *testing.T) {
+	tests := []struct {
+		size  int
+		fails bool
+	}{
+		{0, false},
+		{jpegMaximumPayload, false},
+		{jpegMaximumPayload + 1, true},
+		{70000, true},
+	}
+
+	for _, test := range tests {
+		segment, err := jpegSegment(0xe1, make([]byte, test.size))
+		if test.fails {
+			if err == nil {
+				t.Fatalf("%d bytes: expected an error", test.size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d bytes: %v", test.size, err)
+		}
+		if len(segment) != test.size+4 {
+			t.Fatalf("%d bytes: got a %d byte segment", test.size, len(segment))
+		}
+	}
+}
+
+// Large profiles are split across segments and read back whole.
+func TestIccJpegSegments(t *testing.T) {
+	tests := []struct {
+		size     int
+		segments int
+	}{
+		{3144, 1},
+		{65519, 1},
+		{65520, 2},
+		{200000, 4},
+	}
+
+	for _, test := range tests {
+		data := make([]byte, test.size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+
+		segments, err := (&IccProfile{Data: data}).JpegSegments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) != test.segments {
+			t.Fatalf("%d bytes: expected %d segments, got %d", test.size, test.segments, len(segments))
+		}
+
+		jpeg := []byte{0xff, 0xd8}
+		for _, segment := range segments {
+			jpeg = append(jpeg, segment...)
+		}
+		jpeg = append(jpeg, 0xff, 0xd9)
+
+		raw, err := jpegIcc(jpeg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, data) {
+			t.Fatalf("%d bytes: profile didn't survive, got %d bytes back", test.size, len(raw))
+		}
+	}
+
+	if _, err := (&IccProfile{Data: make([]byte, 256*65519)}).JpegSegments(); err == nil {
+		t.Fatalf("expected a profile needing more than 255 segments to fail")
+	}
+}
+
+func TestParseIcc(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		colorSpace  string
+		description string
+		convert     bool
+		srgb        bool
+		primaries   [3][3]float64
+		half        float64
+	}{
+		{"parametric srgb", rgbIcc(descTag("Unnamed"), srgbD50, srgbCurve), "RGB", "Unnamed", true, true, srgbD50, srgbToLinear(0.5)},
+		{"gamma adobe", rgbIcc(descTag("Compatible with Adobe RGB (1998)"), adobeD50, adobeCurve), "RGB", "Compatible with Adobe RGB (1998)", true, false, adobeD50, math.Pow(0.5, 563.0/256)},
+		{"table", rgbIcc(mlucTag("Linear Rec709 (D50)"), srgbD50, linearTableCurve), "RGB", "Linear Rec709 (D50)", true, false, srgbD50, 0.5},
+		{"named srgb", rgbIcc(mlucTag("sRGB IEC61966-2.1"), adobeD50, adobeCurve), "RGB", "sRGB IEC61966-2.1", true, true, adobeD50, math.Pow(0.5, 563.0/256)},
+		{"gray", syntheticIcc("GRAY", descTag("Gray Gamma 2.2"), gammaTag("kTRC", 2.2)), "GRAY", "Gray Gamma 2.2", true, false, [3][3]float64{}, 0},
+		{"missing primaries", syntheticIcc("RGB", descTag("Broken"), srgbCurve("rTRC")), "RGB", "Broken", false, false, [3][3]float64{}, 0},
+		{"missing curves", syntheticIcc("RGB", descTag("Broken"), xyzTag("rXYZ", 1, 0, 0), xyzTag("gXYZ", 0, 1, 0), xyzTag("bXYZ", 0, 0, 1)), "RGB", "Broken", false, false, [3][3]float64{}, 0},
+		{"cmyk", syntheticIcc("CMYK", descTag("U.S. Web Coated (SWOP) v2")), "CMYK", "U.S. Web Coated (SWOP) v2", false, false, [3][3]float64{}, 0},
+		{"short", make([]byte, 100), "", "", false, false, [3][3]float64{}, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := parseIcc(test.data)
+			if p.ColorSpace != test.colorSpace || p.Description != test.description {
+				t.Fatalf("expected %s '%s', got %s '%s'", test.colorSpace, test.description, p.ColorSpace, p.Description)
+			}
+			if p.CanConvert() != test.convert {
+				t.Fatalf("expected convertible %v (%v)", test.convert, p.parseErr)
+			}
+			if !test.convert {
+				return
+			}
+			if p.IsSRGB() != test.srgb {
+				t.Fatalf("expected srgb %v", test.srgb)
+			}
+			if p.gray != nil {
+				if half := p.gray.apply(0.5); math.Abs(half-math.Pow(0.5, 563.0/256)) > 1e-4 {
+					t.Fatalf("unexpected gray curve %f at half", half)
+				}
+				return
+			}
+			for row := 0; row < 3; row++ {
+				for column := 0; column < 3; column++ {
+					if math.Abs(p.matrix[row][column]-test.primaries[row][column]) > 1e-4 {
+						t.Fatalf("expected %v, got %v", test.primaries, *p.matrix)
+					}
+				}
+			}
+			for channel, curve := range p.curves {
+				if half := curve.apply(0.5); math.Abs(half-test.half) > 1e-4 {
+					t.Fatalf("channel %d: expected %f at half, got %f", channel, test.half, half)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertToSRGB(t *testing.T) {
+	rgb := func(r, g, b uint8) color.Color { return color.RGBA{r, g, b, 255} }
+
+	tests := []struct {
+		name     string
+		profile  []byte
+		input    color.Color
+		expected color.Color
+	}{
+		{"srgb is unchanged", rgbIcc(descTag("Unnamed"), srgbD50, srgbCurve), rgb(200, 100, 30), rgb(200, 100, 30)},
+		{"adobe white", rgbIcc(descTag("Adobe"), adobeD50, adobeCurve), rgb(255, 255, 255), rgb(255, 255, 255)},
+		{"adobe gray", rgbIcc(descTag("Adobe"), adobeD50, adobeCurve), rgb(128, 128, 128), rgb(129, 129, 129)},
+		// Adobe RGB's green is outside sRGB so it's clipped.
+		{"adobe green", rgbIcc(descTag("Adobe"), adobeD50, adobeCurve), rgb(0, 255, 0), rgb(0, 255, 0)},
+		{"adobe muted red", rgbIcc(descTag("Adobe"), adobeD50, adobeCurve), rgb(150, 60, 60), rgb(173, 57, 57)},
+		{"linear table", rgbIcc(descTag("Linear"), srgbD50, linearTableCurve), rgb(128, 128, 128), rgb(188, 188, 188)},
+		{"gray gamma", syntheticIcc("GRAY", descTag("Gray Gamma 2.2"), gammaTag("kTRC", 2.2)), color.Gray{128}, color.Gray{129}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var i draw.Image = image.NewRGBA(image.Rect(0, 0, 2, 2))
+			if _, ok := test.input.(color.Gray); ok {
+				i = image.NewGray(image.Rect(0, 0, 2, 2))
+			}
+			for y := 0; y < 2; y++ {
+				for x := 0; x < 2; x++ {
+					i.Set(x, y, test.input)
+				}
+			}
+
+			converted, err := parseIcc(test.profile).ConvertToSRGB(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			er, eg, eb, _ := test.expected.RGBA()
+			ar, ag, ab, _ := converted.At(1, 1).RGBA()
+			if er>>8 != ar>>8 || eg>>8 != ag>>8 || eb>>8 != ab>>8 {
+				t.Fatalf("expected %v, got %v", test.expected, converted.At(1, 1))
+			}
+		})
+	}
+
+	if _, err := parseIcc(syntheticIcc("CMYK")).ConvertToSRGB(image.NewRGBA(image.Rect(0, 0, 1, 1))); err == nil {
+		t.Fatalf("expected converting from cmyk to fail")
+	}
+}
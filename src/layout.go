@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// LayoutConfig turns on justified rows worked out ahead of time, one
+// layout per container width so pages can pick theirs with a media
+// query and render without scripts or shifting. Spacing is the gap
+// between photos, left out for the default and 0 to put them edge to
+// edge.
+type LayoutConfig struct {
+	RowHeight int   `json:"row_height"`
+	Widths    []int `json:"widths"`
+	Spacing   *int  `json:"spacing"`
+}
+
+const (
+	DefaultLayoutRowHeight = 240
+	DefaultLayoutSpacing   = 4
+)
+
+var DefaultLayoutWidths = []int{360, 768, 1200}
+
+// GalleryLayout places every photo in a container Width pixels wide,
+// File is the photo's index in the album's files.
+type GalleryLayout struct {
+	Width  int
+	Height int
+	Boxes  []*LayoutBox
+}
+
+type LayoutBox struct {
+	File   int
+	Left   int
+	Top    int
+	Width  int
+	Height int
+}
+
+func (c *LayoutConfig) Check() error {
+	if c.Spacing != nil && *c.Spacing < 0 {
+		return fmt.Errorf("layout spacing can't be negative")
+	}
+	return nil
+}
+
+// Only used once Check has passed, so spacing is never negative.
+func (c *LayoutConfig) withDefaults() *LayoutConfig {
+	filled := *c
+	if filled.RowHeight <= 0 {
+		filled.RowHeight = DefaultLayoutRowHeight
+	}
+	if len(filled.Widths) == 0 {
+		filled.Widths = DefaultLayoutWidths
+	}
+	if filled.Spacing == nil {
+		spacing := DefaultLayoutSpacing
+		filled.Spacing = &spacing
+	}
+	return &filled
+}
+
+// The shape the photo is shown at, the large derivative's if there is
+// one since that's what pages show.
+func layoutAspect(af *AlbumFile) float64 {
+	for _, meta := range []*ImageMeta{af.Large, af.Original} {
+		if meta != nil && meta.Dx > 0 && meta.Dy > 0 {
+			return float64(meta.Dx) / float64(meta.Dy)
+		}
+	}
+	return 1
+}
+
+func (g *Generator) Layouts(files []*AlbumFile) []*GalleryLayout {
+	cfg := g.Config.Layout.withDefaults()
+
+	aspects := make([]float64, len(files))
+	for i, af := range files {
+		aspects[i] = layoutAspect(af)
+	}
+
+	layouts := make([]*GalleryLayout, 0, len(cfg.Widths))
+	for _, width := range cfg.Widths {
+		layouts = append(layouts, justify(aspects, width, cfg.RowHeight, *cfg.Spacing))
+	}
+
+	return layouts
+}
+
+// Fills rows left to right, ending each one wherever its height comes
+// closest to the target once it's stretched to the full width. The
+// last row keeps the target height rather than being stretched.
+func justify(aspects []float64, width, rowHeight, spacing int) *GalleryLayout {
+	layout := &GalleryLayout{Width: width, Boxes: make([]*LayoutBox, 0, len(aspects))}
+
+	heightOf := func(start, end int) float64 {
+		sum := 0.0
+		for _, a := range aspects[start:end] {
+			sum += a
+		}
+		return float64(width-spacing*(end-start-1)) / sum
+	}
+
+	top := 0
+	start := 0
+	for start < len(aspects) {
+		end := start + 1
+		for end < len(aspects) && heightOf(start, end) > float64(rowHeight) {
+			// Would one more photo bring the row closer to the target?
+			if math.Abs(heightOf(start, end+1)-float64(rowHeight)) > math.Abs(heightOf(start, end)-float64(rowHeight)) {
+				break
+			}
+			end++
+		}
+
+		height := heightOf(start, end)
+		last := end == len(aspects) && height > float64(rowHeight)
+		if last {
+			height = float64(rowHeight)
+		}
+
+		rowHeight := int(math.Round(height))
+		left := 0.0
+		for i := start; i < end; i++ {
+			boxWidth := aspects[i] * height
+			box := &LayoutBox{
+				File:   i,
+				Left:   int(math.Round(left)),
+				Top:    top,
+				Height: rowHeight,
+			}
+			left += boxWidth + float64(spacing)
+			box.Width = int(math.Round(left-float64(spacing))) - box.Left
+
+			// Rounding shouldn't leave a ragged right edge.
+			if i == end-1 && !last {
+				box.Width = width - box.Left
+			}
+
+			layout.Boxes = append(layout.Boxes, box)
+		}
+
+		top += rowHeight + spacing
+		start = end
+	}
+
+	if top > 0 {
+		layout.Height = top - spacing
+	}
+
+	return layout
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJustify(t *testing.T) {
+	tests := []struct {
+		name     string
+		aspects  []float64
+		width    int
+		spacing  int
+		height   int
+		expected []LayoutBox
+	}{
+		{
+			"empty", []float64{}, 1000, 4, 0,
+			[]LayoutBox{},
+		},
+		{
+			"one panorama fills the width", []float64{6}, 768, 4, 128,
+			[]LayoutBox{{0, 0, 0, 768, 128}},
+		},
+		{
+			"panorama shares a shorter row", []float64{1.5, 6, 1.5}, 1000, 4, 377,
+			[]LayoutBox{
+				{0, 0, 0, 199, 133},
+				{1, 203, 0, 797, 133},
+				{2, 0, 137, 360, 240},
+			},
+		},
+		{
+			"short last row keeps the target height", []float64{1.5, 1.5, 1.5, 1.5, 1}, 1000, 4, 464,
+			[]LayoutBox{
+				{0, 0, 0, 331, 220},
+				{1, 335, 0, 330, 220},
+				{2, 669, 0, 331, 220},
+				{3, 0, 224, 360, 240},
+				{4, 364, 224, 240, 240},
+			},
+		},
+		{
+			"no spacing", []float64{1.5, 1.5, 1.5, 1.5, 1}, 1000, 0, 462,
+			[]LayoutBox{
+				{0, 0, 0, 333, 222},
+				{1, 333, 0, 334, 222},
+				{2, 667, 0, 333, 222},
+				{3, 0, 222, 360, 240},
+				{4, 360, 222, 240, 240},
+			},
+		},
+		{
+			"portraits on a phone", []float64{0.75, 0.75, 0.75}, 360, 4, 481,
+			[]LayoutBox{
+				{0, 0, 0, 178, 237},
+				{1, 182, 0, 178, 237},
+				{2, 0, 241, 180, 240},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layout := justify(test.aspects, test.width, 240, test.spacing)
+
+			boxes := make([]LayoutBox, 0, len(layout.Boxes))
+			for _, box := range layout.Boxes {
+				boxes = append(boxes, *box)
+			}
+
+			if layout.Width != test.width || layout.Height != test.height {
+				t.Fatalf("expected %d x %d, got %d x %d", test.width, test.height, layout.Width, layout.Height)
+			}
+			if !reflect.DeepEqual(boxes, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, boxes)
+			}
+
+			for i, box := range boxes {
+				if box.Left+box.Width > test.width {
+					t.Fatalf("box %d overflows the width", i)
+				}
+				if i > 0 && boxes[i-1].Top == box.Top && boxes[i-1].Left+boxes[i-1].Width+test.spacing != box.Left {
+					t.Fatalf("box %d isn't spaced from the one before it", i)
+				}
+			}
+		})
+	}
+}
+
+func TestLayoutSpacing(t *testing.T) {
+	spacing := func(v int) *int { return &v }
+
+	tests := []struct {
+		name     string
+		spacing  *int
+		expected int
+	}{
+		{"default", nil, DefaultLayoutSpacing},
+		{"edge to edge", spacing(0), 0},
+		{"wider", spacing(8), 8},
+	}
+
+	for _, test := range tests {
+		cfg := &LayoutConfig{Spacing: test.spacing}
+		if err := cfg.Check(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		filled := cfg.withDefaults()
+		if *filled.Spacing != test.expected {
+			t.Fatalf("%s: expected %d, got %d", test.name, test.expected, *filled.Spacing)
+		}
+	}
+
+	if (&LayoutConfig{Spacing: spacing(-1)}).Check() == nil {
+		t.Fatalf("expected negative spacing to be rejected")
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	MetadataSourceXmp      = "xmp"
+	MetadataSourceDatabase = "database"
+	MetadataSourceMerge    = "merge"
+)
+
+// darktable keeps the rating in the low bits of the image flags, and
+// marks rejected images with a separate bit.
+const (
+	darktableRatingMask = 0x7
+	darktableRejected   = 0x8
+)
+
+type libraryImage struct {
+	Id          int64
+	Folder      string
+	Filename    string
+	Version     int64
+	Flags       int64
+	DateTaken   interface{}
+	Latitude    sql.NullFloat64
+	Longitude   sql.NullFloat64
+	Altitude    sql.NullFloat64
+	HistoryEnd  sql.NullInt64
+	ChangeTime  sql.NullInt64
+	Record      *XmpFile
+	SidecarPath string
+}
+
+// Reads images, film rolls, tags, ratings, color labels and history
+// straight out of darktable's library.db, for machines where side car
+// writing is turned off. Tag names live in data.db, which darktable
+// keeps next to the library.
+func (c *Cache) AddDatabase(o *Configuration) error {
+	dataPath := o.Library.Data
+	if dataPath == "" {
+		dataPath = filepath.Join(filepath.Dir(o.Library.Database), "data.db")
+	}
+
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=ro", o.Library.Database))
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	// ATTACH is per connection, so keep it to one.
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec("ATTACH DATABASE ? AS data", fmt.Sprintf("file:%s?mode=ro", dataPath))
+	if err != nil {
+		return fmt.Errorf("%s: %v", dataPath, err)
+	}
+
+	images, err := queryLibraryImages(db)
+	if err != nil {
+		return fmt.Errorf("%s: %v", o.Library.Database, err)
+	}
+
+	err = queryLibraryTags(db, images)
+	if err != nil {
+		return fmt.Errorf("%s: %v", o.Library.Database, err)
+	}
+
+	err = queryLibraryColorLabels(db, images)
+	if err != nil {
+		return fmt.Errorf("%s: %v", o.Library.Database, err)
+	}
+
+	err = queryLibraryHistory(db, images)
+	if err != nil {
+		return fmt.Errorf("%s: %v", o.Library.Database, err)
+	}
+
+	err = queryLibraryMetadata(db, images)
+	if err != nil {
+		return fmt.Errorf("%s: %v", o.Library.Database, err)
+	}
+
+	// Lower versions first, so that duplicates behave the same way
+	// they do when we scan side cars.
+	ids := make([]int64, 0, len(images))
+	for id := range images {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := images[ids[i]], images[ids[j]]
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+		return a.Id < b.Id
+	})
+
+	for _, id := range ids {
+		image := images[id]
+		base := removeAllExtensions(image.Filename)
+
+		if _, ok := c.RecordsByBaseName[base]; ok {
+			if verbose {
+				log.Printf("already have record for base: %s (%d)", image.Filename, image.Id)
+			}
+			continue
+		}
+
+		c.RecordsByBaseName[base] = image.Record
+
+		// We keep the path darktable would write the side car to, so
+		// we have something to report even when it doesn't exist.
+		if _, ok := c.XmpsByBaseName[base]; !ok {
+			c.XmpsByBaseName[base] = image.SidecarPath
+		}
+	}
+
+	log.Printf("loaded %d images from %s", len(images), o.Library.Database)
+
+	return nil
+}
+
+func queryLibraryImages(db *sql.DB) (map[int64]*libraryImage, error) {
+	rows, err := db.Query(`
+		SELECT i.id, f.folder, i.filename, i.version, i.flags, i.datetime_taken,
+		       i.latitude, i.longitude, i.altitude, i.history_end, i.change_timestamp
+		FROM main.images AS i JOIN main.film_rolls AS f ON (i.film_id = f.id)`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	images := make(map[int64]*libraryImage)
+
+	for rows.Next() {
+		image := &libraryImage{}
+		err := rows.Scan(&image.Id, &image.Folder, &image.Filename, &image.Version, &image.Flags, &image.DateTaken,
+			&image.Latitude, &image.Longitude, &image.Altitude, &image.HistoryEnd, &image.ChangeTime)
+		if err != nil {
+			return nil, err
+		}
+
+		image.SidecarPath = darktableSidecarPath(image.Folder, image.Filename, image.Version)
+		image.Record = image.toXmp()
+
+		images[image.Id] = image
+	}
+
+	return images, rows.Err()
+}
+
+func queryLibraryTags(db *sql.DB, images map[int64]*libraryImage) error {
+	rows, err := db.Query(`
+		SELECT ti.imgid, t.name
+		FROM main.tagged_images AS ti JOIN data.tags AS t ON (ti.tagid = t.id)
+		ORDER BY ti.imgid, t.name`)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+
+		// darktable's own bookkeeping tags never make it into side cars.
+		if strings.HasPrefix(name, "darktable|") {
+			continue
+		}
+
+		if image, ok := images[id]; ok {
+			d := &image.Record.Rdf.Description
+			d.HierarchicalSubjects.Subjects = append(d.HierarchicalSubjects.Subjects, name)
+			parts := strings.Split(name, "|")
+			d.Subjects.Subjects = append(d.Subjects.Subjects, parts[len(parts)-1])
+		}
+	}
+
+	return rows.Err()
+}
+
+func queryLibraryColorLabels(db *sql.DB, images map[int64]*libraryImage) error {
+	rows, err := db.Query(`SELECT imgid, color FROM main.color_labels ORDER BY imgid, color`)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, color int64
+		if err := rows.Scan(&id, &color); err != nil {
+			return err
+		}
+
+		if image, ok := images[id]; ok {
+			d := &image.Record.Rdf.Description
+			d.ColorLabels = append(d.ColorLabels, strconv.FormatInt(color, 10))
+		}
+	}
+
+	return rows.Err()
+}
+
+func queryLibraryHistory(db *sql.DB, images map[int64]*libraryImage) error {
+	rows, err := db.Query(`
+		SELECT imgid, num, module, operation, op_params, enabled, multi_priority, multi_name
+		FROM main.history ORDER BY imgid, num`)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var params []byte
+		var multiName sql.NullString
+		h := DarkTableHistory{}
+		if err := rows.Scan(&id, &h.Number, &h.ModuleVersion, &h.Operation, &params, &h.Enabled, &h.MultiPriority, &multiName); err != nil {
+			return err
+		}
+
+		h.Params = hex.EncodeToString(params)
+		h.MultiName = multiName.String
+
+		if image, ok := images[id]; ok {
+			d := &image.Record.Rdf.Description
+			d.History = append(d.History, h)
+		}
+	}
+
+	return rows.Err()
+}
+
+// The side car for version 0 is IMG.ARW.xmp, later versions are
+// IMG_01.ARW.xmp and so on.
+func darktableSidecarPath(folder, filename string, version int64) string {
+	if version > 0 {
+		extension := filepath.Ext(filename)
+		filename = fmt.Sprintf("%s_%02d%s", strings.TrimSuffix(filename, extension), version, extension)
+	}
+	return filepath.Join(folder, filename+".xmp")
+}
+
+func (image *libraryImage) toXmp() *XmpFile {
+	xmp := &XmpFile{}
+	d := &xmp.Rdf.Description
+
+	d.Rating = image.Flags & darktableRatingMask
+	if image.Flags&darktableRejected != 0 {
+		d.Rating = -1
+	}
+
+	switch taken := image.DateTaken.(type) {
+	case int64:
+		// Wall clock time as microseconds since 0001-01-01.
+		if taken > 0 {
+			d.DateTimeOriginal = time.Unix(taken/1e6-darktableEpochOffset, 0).UTC().Format("2006:01:02 15:04:05")
+		}
+	case string:
+		d.DateTimeOriginal = taken
+	case []byte:
+		d.DateTimeOriginal = string(taken)
+	}
+
+	if image.Latitude.Valid && image.Longitude.Valid && !math.IsNaN(image.Latitude.Float64) && !math.IsNaN(image.Longitude.Float64) {
+		d.GPSLatitude = formatXmpCoordinate(image.Latitude.Float64, "N", "S")
+		d.GPSLongitude = formatXmpCoordinate(image.Longitude.Float64, "E", "W")
+		if image.Altitude.Valid && !math.IsNaN(image.Altitude.Float64) {
+			altitude := image.Altitude.Float64
+			if altitude < 0 {
+				d.GPSAltitudeRef = "1"
+				altitude = -altitude
+			}
+			d.GPSAltitude = fmt.Sprintf("%d/100", int64(math.Round(altitude*100)))
+		}
+	}
+
+	if image.HistoryEnd.Valid {
+		end := image.HistoryEnd.Int64
+		d.HistoryEnd = &end
+	}
+
+	if image.ChangeTime.Valid {
+		d.ChangeTimestamp = strconv.FormatInt(image.ChangeTime.Int64, 10)
+	}
+
+	return xmp
+}
+
+func formatXmpCoordinate(value float64, positive, negative string) string {
+	ref := positive
+	if value < 0 {
+		ref = negative
+		value = -value
+	}
+	degrees := math.Floor(value)
+	minutes := (value - degrees) * 60
+	return fmt.Sprintf("%d,%.6f%s", int64(degrees), minutes, ref)
+}
+
+// Side car values win, except that tags and color labels from both
+// sources are combined.
+func mergeMetadata(sidecar, record *XmpFile) *XmpFile {
+	merged := *sidecar
+	d := &merged.Rdf.Description
+	r := record.Rdf.Description
+
+	d.HierarchicalSubjects.Subjects = unionStrings(d.HierarchicalSubjects.Subjects, r.HierarchicalSubjects.Subjects)
+	d.Subjects.Subjects = unionStrings(d.Subjects.Subjects, r.Subjects.Subjects)
+	d.ColorLabels = unionStrings(d.ColorLabels, r.ColorLabels)
+
+	if d.Rating == 0 {
+		d.Rating = r.Rating
+	}
+	if d.DateTimeOriginal == "" {
+		d.DateTimeOriginal = r.DateTimeOriginal
+	}
+	if d.GPSLatitude == "" && d.GPSLongitude == "" {
+		d.GPSLatitude = r.GPSLatitude
+		d.GPSLongitude = r.GPSLongitude
+		d.GPSAltitude = r.GPSAltitude
+		d.GPSAltitudeRef = r.GPSAltitudeRef
+	}
+	if len(d.History) == 0 {
+		d.History = r.History
+		d.HistoryEnd = r.HistoryEnd
+	}
+	if d.ChangeTimestamp == "" {
+		d.ChangeTimestamp = r.ChangeTimestamp
+	}
+	if len(d.Creator) == 0 {
+		d.Creator = r.Creator
+	}
+	if len(d.Rights) == 0 {
+		d.Rights = r.Rights
+	}
+	if len(d.Title) == 0 {
+		d.Title = r.Title
+	}
+	if len(d.Caption) == 0 {
+		d.Caption = r.Caption
+	}
+
+	return &merged
+}
+
+func unionStrings(a, b []string) []string {
+	seen := make(map[string]bool)
+	union := make([]string, 0, len(a)+len(b))
+	for _, values := range [][]string{a, b} {
+		for _, v := range values {
+			if !seen[v] {
+				seen[v] = true
+				union = append(union, v)
+			}
+		}
+	}
+	return union
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Just the tables and columns we read, darktable's have many more.
+var librarySchema = []string{
+	`CREATE TABLE film_rolls (id INTEGER PRIMARY KEY, folder TEXT)`,
+	`CREATE TABLE images (id INTEGER PRIMARY KEY, film_id INTEGER, filename TEXT, version INTEGER, flags INTEGER,
+		datetime_taken INTEGER, latitude REAL, longitude REAL, altitude REAL, history_end INTEGER, change_timestamp INTEGER)`,
+	`CREATE TABLE tagged_images (imgid INTEGER, tagid INTEGER)`,
+	`CREATE TABLE color_labels (imgid INTEGER, color INTEGER)`,
+	`CREATE TABLE history (imgid INTEGER, num INTEGER, module INTEGER, operation TEXT, op_params BLOB,
+		enabled INTEGER, multi_priority INTEGER, multi_name TEXT)`,
+	`CREATE TABLE meta_data (id INTEGER, key INTEGER, value TEXT)`,
+	`INSERT INTO film_rolls VALUES (1, '/photos/2021/france')`,
+	// 2021-07-14 10:00:30 as microseconds since 0001-01-01.
+	`INSERT INTO images VALUES (1, 1, 'DSC001.ARW', 0, 4, 63761853630000000, 48.8566, 2.3522, 35.5, 2, 63761853700000000)`,
+	`INSERT INTO images VALUES (2, 1, 'DSC001.ARW', 1, 1, NULL, NULL, NULL, NULL, 0, NULL)`,
+	`INSERT INTO images VALUES (3, 1, 'DSC002.ARW', 0, 9, NULL, -33.5, -70.25, -12, NULL, NULL)`,
+	`INSERT INTO tagged_images VALUES (1, 1), (1, 2), (1, 3), (3, 2)`,
+	`INSERT INTO color_labels VALUES (1, 2), (1, 0)`,
+	`INSERT INTO history VALUES (1, 0, 7, 'exposure', x'00ff', 1, 0, NULL), (1, 1, 2, 'crop', x'0a0b', 1, 0, '')`,
+	`INSERT INTO meta_data VALUES (1, 0, 'Jacob'), (1, 2, 'Bastille Day'), (1, 4, 'CC BY')`,
+}
+
+var dataSchema = []string{
+	`CREATE TABLE tags (id INTEGER PRIMARY KEY, name TEXT)`,
+	`INSERT INTO tags VALUES (1, 'places|france|paris'), (2, 'trip'), (3, 'darktable|format|arw')`,
+}
+
+func createSqlite(t *testing.T, path string, statements []string) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+}
+
+func TestAddDatabase(t *testing.T) {
+	dir := t.TempDir()
+	createSqlite(t, filepath.Join(dir, "library.db"), librarySchema)
+	createSqlite(t, filepath.Join(dir, "data.db"), dataSchema)
+
+	c := &Cache{
+		XmpsByBaseName:    map[string]string{"DSC002": "/elsewhere/DSC002.ARW.xmp"},
+		RecordsByBaseName: make(map[string]*XmpFile),
+	}
+	err := c.AddDatabase(&Configuration{Library: &LibraryConfig{Database: filepath.Join(dir, "library.db")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedXmps := map[string]string{
+		"DSC001": "/photos/2021/france/DSC001.ARW.xmp",
+		"DSC002": "/elsewhere/DSC002.ARW.xmp",
+	}
+	if !reflect.DeepEqual(c.XmpsByBaseName, expectedXmps) {
+		t.Fatalf("expected %v, got %v", expectedXmps, c.XmpsByBaseName)
+	}
+
+	// The duplicate at version 1 loses to the original.
+	d := c.RecordsByBaseName["DSC001"].Rdf.Description
+	end := int64(2)
+	expected := RdfDescription{
+		Rating:               4,
+		DateTimeOriginal:     "2021:07:14 10:00:30",
+		GPSLatitude:          "48,51.396000N",
+		GPSLongitude:         "2,21.132000E",
+		GPSAltitude:          "3550/100",
+		HistoryEnd:           &end,
+		ChangeTimestamp:      "63761853700000000",
+		ColorLabels:          []string{"0", "2"},
+		Creator:              []string{"Jacob"},
+		Title:                []string{"Bastille Day"},
+		Rights:               []string{"CC BY"},
+		Subjects:             Subjects{Subjects: []string{"paris", "trip"}},
+		HierarchicalSubjects: HierarchicalSubjects{Subjects: []string{"places|france|paris", "trip"}},
+		History: []DarkTableHistory{
+			{Number: 0, ModuleVersion: 7, Operation: "exposure", Params: "00ff", Enabled: 1},
+			{Number: 1, ModuleVersion: 2, Operation: "crop", Params: "0a0b", Enabled: 1},
+		},
+	}
+	if !reflect.DeepEqual(d, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, d)
+	}
+
+	rejected := c.RecordsByBaseName["DSC002"].Rdf.Description
+	if rejected.Rating != -1 || rejected.GPSLatitude != "33,30.000000S" || rejected.GPSLongitude != "70,15.000000W" {
+		t.Fatalf("unexpected record %+v", rejected)
+	}
+	if rejected.GPSAltitude != "1200/100" || rejected.GPSAltitudeRef != "1" || rejected.HistoryEnd != nil {
+		t.Fatalf("unexpected record %+v", rejected)
+	}
+}
+
+func TestDarktableSidecarPath(t *testing.T) {
+	tests := []struct {
+		version  int64
+		expected string
+	}{
+		{0, "/photos/DSC001.ARW.xmp"},
+		{1, "/photos/DSC001_01.ARW.xmp"},
+		{12, "/photos/DSC001_12.ARW.xmp"},
+	}
+
+	for _, test := range tests {
+		if actual := darktableSidecarPath("/photos", "DSC001.ARW", test.version); actual != test.expected {
+			t.Fatalf("version %d: expected %s, got %s", test.version, test.expected, actual)
+		}
+	}
+}
+
+func TestLibraryImageToXmp(t *testing.T) {
+	valid := func(v float64) sql.NullFloat64 { return sql.NullFloat64{Float64: v, Valid: true} }
+
+	tests := []struct {
+		name     string
+		image    *libraryImage
+		rating   int64
+		date     string
+		gps      string
+		altitude string
+		end      string
+	}{
+		{"empty", &libraryImage{}, 0, "", ",", "", "nil"},
+		{"rated", &libraryImage{Flags: 5}, 5, "", ",", "", "nil"},
+		{"rejected", &libraryImage{Flags: 8 | 3}, -1, "", ",", "", "nil"},
+		{"text date", &libraryImage{DateTaken: "2021:07:14 10:00:30"}, 0, "2021:07:14 10:00:30", ",", "", "nil"},
+		{"unset date", &libraryImage{DateTaken: int64(0)}, 0, "", ",", "", "nil"},
+		{"not a number", &libraryImage{Latitude: valid(math.NaN()), Longitude: valid(2)}, 0, "", ",", "", "nil"},
+		{"without altitude", &libraryImage{Latitude: valid(0.5), Longitude: valid(-0.25)}, 0, "", "0,30.000000N,0,15.000000W", "", "nil"},
+		{"below sea level", &libraryImage{Latitude: valid(31.5), Longitude: valid(35.5), Altitude: valid(-430.25)}, 0, "", "31,30.000000N,35,30.000000E", "43025/100 1", "nil"},
+		{"every edit undone", &libraryImage{HistoryEnd: sql.NullInt64{Int64: 0, Valid: true}}, 0, "", ",", "", "0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := test.image.toXmp().Rdf.Description
+			if d.Rating != test.rating || d.DateTimeOriginal != test.date {
+				t.Fatalf("expected %d %q, got %d %q", test.rating, test.date, d.Rating, d.DateTimeOriginal)
+			}
+			if gps := d.GPSLatitude + "," + d.GPSLongitude; gps != test.gps {
+				t.Fatalf("expected %s, got %s", test.gps, gps)
+			}
+			altitude := d.GPSAltitude
+			if d.GPSAltitudeRef != "" {
+				altitude += " " + d.GPSAltitudeRef
+			}
+			if altitude != test.altitude {
+				t.Fatalf("expected altitude %q, got %q", test.altitude, altitude)
+			}
+			end := "nil"
+			if d.HistoryEnd != nil {
+				end = fmt.Sprint(*d.HistoryEnd)
+			}
+			if end != test.end {
+				t.Fatalf("expected history_end %s, got %s", test.end, end)
+			}
+		})
+	}
+}
+
+func TestMergeMetadata(t *testing.T) {
+	end := int64(1)
+
+	sidecar := &XmpFile{}
+	s := &sidecar.Rdf.Description
+	s.Rating = 3
+	s.GPSLatitude, s.GPSLongitude = "48,51.396000N", "2,21.132000E"
+	s.HierarchicalSubjects.Subjects = []string{"trip", "places|france"}
+	s.ColorLabels = []string{"1"}
+	s.Title = []string{"From the side car"}
+
+	record := &XmpFile{}
+	r := &record.Rdf.Description
+	r.Rating = 5
+	r.DateTimeOriginal = "2021:07:14 10:00:30"
+	r.GPSLatitude, r.GPSLongitude, r.GPSAltitude = "1,0.000000N", "1,0.000000E", "100/100"
+	r.HierarchicalSubjects.Subjects = []string{"places|france", "people|jacob"}
+	r.ColorLabels = []string{"1", "3"}
+	r.History = []DarkTableHistory{{Operation: "exposure"}}
+	r.HistoryEnd = &end
+	r.Title = []string{"From the library"}
+	r.Caption = []string{"Only in the library"}
+
+	m := mergeMetadata(sidecar, record).Rdf.Description
+
+	if m.Rating != 3 || m.DateTimeOriginal != r.DateTimeOriginal {
+		t.Fatalf("unexpected rating or date %d %s", m.Rating, m.DateTimeOriginal)
+	}
+	if m.GPSLatitude != s.GPSLatitude || m.GPSAltitude != "" {
+		t.Fatalf("the side car's location should be kept whole, got %s %s", m.GPSLatitude, m.GPSAltitude)
+	}
+	if !reflect.DeepEqual(m.HierarchicalSubjects.Subjects, []string{"trip", "places|france", "people|jacob"}) {
+		t.Fatalf("unexpected tags %v", m.HierarchicalSubjects.Subjects)
+	}
+	if !reflect.DeepEqual(m.ColorLabels, []string{"1", "3"}) {
+		t.Fatalf("unexpected labels %v", m.ColorLabels)
+	}
+	if len(m.History) != 1 || m.HistoryEnd != &end {
+		t.Fatalf("expected the library's history")
+	}
+	if m.Title[0] != "From the side car" || m.Caption[0] != "Only in the library" {
+		t.Fatalf("unexpected title and caption %v %v", m.Title, m.Caption)
+	}
+	if len(s.HierarchicalSubjects.Subjects) != 2 {
+		t.Fatalf("the side car was modified")
+	}
+}
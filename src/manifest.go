@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const ManifestName = ".manifest.json"
+
+// Manifest remembers how every derivative under the albums root was
+// made, so we can tell when one is out of date and so there's a record
+// of what was done to the pixels.
+type Manifest struct {
+	Derivatives map[string]*DerivativeRecord `json:"derivatives"`
+	Sources     map[string]*SourceRecord     `json:"sources"`
+
+	root string
+}
+
+type DerivativeRecord struct {
+	Source   string         `json:"source"`
+	Profile  string         `json:"profile"`
+	Settings string         `json:"settings"`
+	Color    *ColorRecord   `json:"color,omitempty"`
+	Metadata *PhotoMetadata `json:"metadata,omitempty"`
+	Quality  int            `json:"quality"`
+	Bytes    int            `json:"bytes"`
+}
+
+// SourceRecord keeps what we've worked out about a source image, for
+// as long as the file doesn't change.
+type SourceRecord struct {
+	Size        int64        `json:"size"`
+	ModTime     time.Time    `json:"mod_time"`
+	Placeholder *Placeholder `json:"placeholder,omitempty"`
+	DHash       string       `json:"dhash,omitempty"`
+	CoverScore  *float64     `json:"cover_score,omitempty"`
+}
+
+type ColorRecord struct {
+	Policy        string `json:"policy"`
+	SourceProfile string `json:"source_profile,omitempty"`
+	Applied       string `json:"applied"`
+}
+
+func OpenManifest(albumsRoot string) (*Manifest, error) {
+	m := &Manifest{
+		Derivatives: make(map[string]*DerivativeRecord),
+		Sources:     make(map[string]*SourceRecord),
+		root:        albumsRoot,
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(albumsRoot, ManifestName))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Derivatives == nil {
+		m.Derivatives = make(map[string]*DerivativeRecord)
+	}
+
+	if m.Sources == nil {
+		m.Sources = make(map[string]*SourceRecord)
+	}
+
+	// Sources used to be keyed by their full path.
+	for path, record := range m.Sources {
+		if key := m.key(path); filepath.IsAbs(path) && key != path {
+			delete(m.Sources, path)
+			m.Sources[key] = record
+		}
+	}
+
+	return m, nil
+}
+
+// Paths are kept relative to the albums root, so the manifest still
+// works if the root and what's around it move.
+func (m *Manifest) key(path string) string {
+	if relative, err := filepath.Rel(m.root, path); err == nil {
+		return filepath.ToSlash(relative)
+	}
+	return path
+}
+
+func (m *Manifest) Get(path string) *DerivativeRecord {
+	return m.Derivatives[m.key(path)]
+}
+
+// A derivative is current when it exists and was made from the same
+// source with the same settings.
+func (m *Manifest) Current(path, source, settings string) bool {
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+
+	record := m.Get(path)
+	if record == nil {
+		return false
+	}
+
+	return record.Source == source && record.Settings == settings
+}
+
+func (m *Manifest) Record(path string, record *DerivativeRecord) {
+	m.Derivatives[m.key(path)] = record
+}
+
+// Returns the record for a source, starting over if the file changed.
+func (m *Manifest) Source(path string, info os.FileInfo) *SourceRecord {
+	key := m.key(path)
+	record := m.Sources[key]
+	if record == nil || record.Size != info.Size() || !record.ModTime.Equal(info.ModTime()) {
+		record = &SourceRecord{
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		m.Sources[key] = record
+	}
+	return record
+}
+
+func (m *Manifest) Save() error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(m.root, ManifestName), data, 0644)
+}
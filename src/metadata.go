@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Fields a profile can choose to write into its derivatives. This is
+// deliberately a short list of things we want the world to see, we
+// build the metadata from scratch rather than copying from the source
+// so GPS, camera serial numbers and darktable's history never leak.
+const (
+	MetadataCopyright = "copyright"
+	MetadataCreator   = "creator"
+	MetadataTitle     = "title"
+	MetadataCaption   = "caption"
+	MetadataDate      = "date"
+)
+
+var (
+	metadataFields = []string{MetadataCopyright, MetadataCreator, MetadataTitle, MetadataCaption, MetadataDate}
+
+	DefaultProfileMetadata = []string{MetadataCopyright, MetadataCreator}
+)
+
+// MetadataConfig provides values for photos that don't have their own.
+type MetadataConfig struct {
+	Creator   string `json:"creator"`
+	Copyright string `json:"copyright"`
+}
+
+// PhotoMetadata is what gets written into a derivative, fields that
+// weren't chosen or have no value are empty.
+type PhotoMetadata struct {
+	Copyright string `json:"copyright,omitempty"`
+	Creator   string `json:"creator,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Caption   string `json:"caption,omitempty"`
+	Date      string `json:"date,omitempty"`
+}
+
+// darktable's meta_data keys, from the order of dt_metadata_t.
+const (
+	darktableMetadataCreator     = 0
+	darktableMetadataTitle       = 2
+	darktableMetadataDescription = 3
+	darktableMetadataRights      = 4
+)
+
+func queryLibraryMetadata(db *sql.DB, images map[int64]*libraryImage) error {
+	rows, err := db.Query(`SELECT id, key, value FROM main.meta_data ORDER BY id, key`)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, key int64
+		var value string
+		if err := rows.Scan(&id, &key, &value); err != nil {
+			return err
+		}
+
+		image, ok := images[id]
+		if !ok {
+			continue
+		}
+
+		d := &image.Record.Rdf.Description
+		switch key {
+		case darktableMetadataCreator:
+			d.Creator = append(d.Creator, value)
+		case darktableMetadataTitle:
+			d.Title = append(d.Title, value)
+		case darktableMetadataDescription:
+			d.Caption = append(d.Caption, value)
+		case darktableMetadataRights:
+			d.Rights = append(d.Rights, value)
+		}
+	}
+
+	return rows.Err()
+}
+
+func firstValue(values []string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Returns the chosen fields for a photo, falling back to the
+// configured creator and copyright.
+func (g *Generator) PhotoMetadata(source string, fields []string) (*PhotoMetadata, error) {
+	pm := &PhotoMetadata{}
+	if len(fields) == 0 {
+		return pm, nil
+	}
+
+	xmp, _, err := g.Cache.FindMetadata(derivativeName(source))
+	if err != nil {
+		return nil, err
+	}
+
+	all := &PhotoMetadata{}
+	if xmp != nil {
+		d := xmp.Rdf.Description
+		all.Copyright = firstValue(d.Rights)
+		all.Creator = strings.Join(d.Creator, ", ")
+		all.Title = firstValue(d.Title)
+		all.Caption = firstValue(d.Caption)
+		all.Date = d.DateTimeOriginal
+	}
+
+	if defaults := g.Config.Metadata; defaults != nil {
+		if all.Copyright == "" {
+			all.Copyright = defaults.Copyright
+		}
+		if all.Creator == "" {
+			all.Creator = defaults.Creator
+		}
+	}
+
+	for _, field := range fields {
+		switch field {
+		case MetadataCopyright:
+			pm.Copyright = all.Copyright
+		case MetadataCreator:
+			pm.Creator = all.Creator
+		case MetadataTitle:
+			pm.Title = all.Title
+		case MetadataCaption:
+			pm.Caption = all.Caption
+		case MetadataDate:
+			pm.Date = all.Date
+		}
+	}
+
+	return pm, nil
+}
+
+func (pm *PhotoMetadata) Empty() bool {
+	return *pm == PhotoMetadata{}
+}
+
+func (pm *PhotoMetadata) Settings() string {
+	data, err := json.Marshal(pm)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+// The segments carrying this metadata, EXIF for older software and
+// XMP for anything that wants more than ASCII. Neither can be split,
+// a caption too long for one segment is an error.
+func (pm *PhotoMetadata) JpegSegments() ([][]byte, error) {
+	if pm.Empty() {
+		return nil, nil
+	}
+
+	exif, err := jpegSegment(0xe1, append([]byte("Exif\x00\x00"), pm.exif()...))
+	if err != nil {
+		return nil, fmt.Errorf("exif: %v", err)
+	}
+
+	xmp, err := jpegSegment(0xe1, append([]byte("http://ns.adobe.com/xap/1.0/\x00"), pm.xmp()...))
+	if err != nil {
+		return nil, fmt.Errorf("xmp: %v", err)
+	}
+
+	return [][]byte{exif, xmp}, nil
+}
+
+type exifEntry struct {
+	Tag   uint16
+	Kind  uint16
+	Count uint32
+	Value []byte
+}
+
+const (
+	exifAscii = 2
+	exifLong  = 4
+)
+
+func exifString(tag uint16, value string) *exifEntry {
+	data := append([]byte(value), 0)
+	return &exifEntry{Tag: tag, Kind: exifAscii, Count: uint32(len(data)), Value: data}
+}
+
+// Writes an IFD at offset, with values that don't fit in an entry
+// following it. Returns the IFD and its values.
+func exifIfd(entries []*exifEntry, offset uint32) []byte {
+	size := uint32(2 + len(entries)*12 + 4)
+	ifd := make([]byte, size)
+	values := make([]byte, 0)
+
+	binary.BigEndian.PutUint16(ifd, uint16(len(entries)))
+	for i, e := range entries {
+		entry := ifd[2+i*12:]
+		binary.BigEndian.PutUint16(entry, e.Tag)
+		binary.BigEndian.PutUint16(entry[2:], e.Kind)
+		binary.BigEndian.PutUint32(entry[4:], e.Count)
+		if len(e.Value) <= 4 {
+			copy(entry[8:], e.Value)
+			continue
+		}
+		binary.BigEndian.PutUint32(entry[8:], offset+size+uint32(len(values)))
+		values = append(values, e.Value...)
+		if len(values)%2 != 0 {
+			values = append(values, 0)
+		}
+	}
+
+	return append(ifd, values...)
+}
+
+func (pm *PhotoMetadata) exif() []byte {
+	entries := make([]*exifEntry, 0)
+
+	description := pm.Caption
+	if description == "" {
+		description = pm.Title
+	}
+	if description != "" {
+		entries = append(entries, exifString(0x010e, description))
+	}
+	if pm.Creator != "" {
+		entries = append(entries, exifString(0x013b, pm.Creator))
+	}
+	if pm.Copyright != "" {
+		entries = append(entries, exifString(0x8298, pm.Copyright))
+	}
+
+	var exifIfdEntries []*exifEntry
+	if _, err := time.Parse("2006:01:02 15:04:05", pm.Date); err == nil {
+		exifIfdEntries = append(exifIfdEntries, exifString(0x9003, pm.Date))
+		// Filled in below, once we know where IFD0 ends.
+		entries = append(entries, &exifEntry{Tag: 0x8769, Kind: exifLong, Count: 1, Value: make([]byte, 4)})
+	}
+
+	header := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	ifd0 := exifIfd(entries, 8)
+
+	if exifIfdEntries != nil {
+		offset := uint32(8 + len(ifd0))
+		pointer := entries[len(entries)-1]
+		binary.BigEndian.PutUint32(pointer.Value, offset)
+		ifd0 = exifIfd(entries, 8)
+		return append(append(header, ifd0...), exifIfd(exifIfdEntries, offset)...)
+	}
+
+	return append(header, ifd0...)
+}
+
+func xmlEscape(value string) string {
+	escaped := &bytes.Buffer{}
+	xml.EscapeText(escaped, []byte(value))
+	return escaped.String()
+}
+
+func (pm *PhotoMetadata) xmp() []byte {
+	b := &bytes.Buffer{}
+
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	b.WriteString("  <rdf:Description rdf:about=\"\"\n")
+	b.WriteString("    xmlns:dc=\"http://purl.org/dc/elements/1.1/\"\n")
+	b.WriteString("    xmlns:photoshop=\"http://ns.adobe.com/photoshop/1.0/\">\n")
+
+	alt := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(b, "   <dc:%s><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:%s>\n", name, xmlEscape(value), name)
+		}
+	}
+
+	if pm.Creator != "" {
+		fmt.Fprintf(b, "   <dc:creator><rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq></dc:creator>\n", xmlEscape(pm.Creator))
+	}
+	alt("rights", pm.Copyright)
+	alt("title", pm.Title)
+	alt("description", pm.Caption)
+
+	if pm.Date != "" {
+		if date, err := time.Parse("2006:01:02 15:04:05", pm.Date); err == nil {
+			fmt.Fprintf(b, "   <photoshop:DateCreated>%s</photoshop:DateCreated>\n", date.Format("2006-01-02T15:04:05"))
+		}
+	}
+
+	b.WriteString("  </rdf:Description>\n")
+	b.WriteString(" </rdf:RDF>\n")
+	b.WriteString("</x:xmpmeta>\n")
+	b.WriteString("<?xpacket end=\"w\"?>")
+
+	return b.Bytes()
+}
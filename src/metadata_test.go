@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// Reads the ASCII entries of the IFD at offset in a big endian TIFF,
+// and the offset of the next IFD pointed to by tag 0x8769.
+func readExifStrings(t *testing.T, tiff []byte, offset uint32) (map[uint16]string, uint32) {
+	t.Helper()
+
+	values := make(map[uint16]string)
+	pointer := uint32(0)
+
+	count := int(binary.BigEndian.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := tiff[int(offset)+2+i*12:]
+		tag := binary.BigEndian.Uint16(entry)
+		kind := binary.BigEndian.Uint16(entry[2:])
+		n := binary.BigEndian.Uint32(entry[4:])
+
+		switch kind {
+		case exifLong:
+			if tag == 0x8769 {
+				pointer = binary.BigEndian.Uint32(entry[8:])
+			}
+		case exifAscii:
+			data := entry[8 : 8+n]
+			if n > 4 {
+				at := binary.BigEndian.Uint32(entry[8:])
+				if int(at+n) > len(tiff) {
+					t.Fatalf("tag %x points past the end", tag)
+				}
+				data = tiff[at : at+n]
+			}
+			if data[len(data)-1] != 0 {
+				t.Fatalf("tag %x isn't terminated", tag)
+			}
+			values[tag] = string(data[:len(data)-1])
+		default:
+			t.Fatalf("unexpected kind %d", kind)
+		}
+	}
+
+	return values, pointer
+}
+
+func TestExifIfd(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []*exifEntry
+		size    int
+	}{
+		{"empty", nil, 6},
+		{"inline", []*exifEntry{exifString(0x013b, "Ann")}, 18},
+		{"outside", []*exifEntry{exifString(0x013b, "Jacob")}, 18 + 6},
+		{"padded", []*exifEntry{exifString(0x013b, "Jacob!"), exifString(0x8298, "CC")}, 30 + 8},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ifd := exifIfd(test.entries, 8)
+			if len(ifd) != test.size {
+				t.Fatalf("expected %d bytes, got %d", test.size, len(ifd))
+			}
+
+			tiff := append(make([]byte, 8), ifd...)
+			values, _ := readExifStrings(t, tiff, 8)
+			for _, e := range test.entries {
+				if values[e.Tag]+"\x00" != string(e.Value) {
+					t.Errorf("tag %x: got %q", e.Tag, values[e.Tag])
+				}
+			}
+		})
+	}
+}
+
+func TestPhotoMetadataExif(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata *PhotoMetadata
+		ifd0     map[uint16]string
+		date     string
+	}{
+		{
+			name:     "caption wins over title",
+			metadata: &PhotoMetadata{Title: "Title", Caption: "A longer caption", Creator: "Jacob", Copyright: "CC BY"},
+			ifd0:     map[uint16]string{0x010e: "A longer caption", 0x013b: "Jacob", 0x8298: "CC BY"},
+		},
+		{
+			name:     "title without caption",
+			metadata: &PhotoMetadata{Title: "Title"},
+			ifd0:     map[uint16]string{0x010e: "Title"},
+		},
+		{
+			name:     "date goes in the exif ifd",
+			metadata: &PhotoMetadata{Creator: "Jacob", Date: "2021:07:14 10:00:30"},
+			ifd0:     map[uint16]string{0x013b: "Jacob"},
+			date:     "2021:07:14 10:00:30",
+		},
+		{
+			name:     "unparseable date is left out",
+			metadata: &PhotoMetadata{Date: "yesterday"},
+			ifd0:     map[uint16]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tiff := test.metadata.exif()
+			if !bytes.HasPrefix(tiff, []byte("MM\x00\x2a\x00\x00\x00\x08")) {
+				t.Fatalf("bad header % x", tiff[:8])
+			}
+
+			values, pointer := readExifStrings(t, tiff, 8)
+			if len(values) != len(test.ifd0) {
+				t.Errorf("expected %v, got %v", test.ifd0, values)
+			}
+			for tag, expected := range test.ifd0 {
+				if values[tag] != expected {
+					t.Errorf("tag %x: expected %q, got %q", tag, expected, values[tag])
+				}
+			}
+
+			if test.date == "" {
+				if pointer != 0 {
+					t.Errorf("unexpected exif ifd at %d", pointer)
+				}
+				return
+			}
+
+			exif, _ := readExifStrings(t, tiff, pointer)
+			if exif[0x9003] != test.date {
+				t.Errorf("expected date %q, got %q", test.date, exif[0x9003])
+			}
+		})
+	}
+}
+
+func TestPhotoMetadataSegments(t *testing.T) {
+	segments, err := (&PhotoMetadata{Caption: "A caption"}).JpegSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("expected exif and xmp, got %d segments", len(segments))
+	}
+	for _, segment := range segments {
+		if length := int(binary.BigEndian.Uint16(segment[2:])); length != len(segment)-2 {
+			t.Fatalf("segment is %d bytes but claims %d", len(segment)-2, length)
+		}
+	}
+
+	long := &PhotoMetadata{Caption: strings.Repeat("a", 70000)}
+	if _, err := long.JpegSegments(); err == nil {
+		t.Fatalf("expected a caption too long for a segment to fail")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+type opaquer interface {
+	Opaque() bool
+}
+
+// Converts decoded images into something the resizer and the JPEG
+// encoder handle well. JPEG decodes are left alone, deeper images are
+// brought down to 8 bits per channel and anything with transparency is
+// flattened onto white, because JPEG has no alpha and the encoder
+// would otherwise turn transparent areas black.
+func normalizeImage(i image.Image) image.Image {
+	switch i.(type) {
+	case *image.YCbCr, *image.CMYK, *image.Gray:
+		return i
+	case *image.Gray16:
+		bounds := i.Bounds()
+		gray := image.NewGray(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				gray.Set(x, y, color.GrayModel.Convert(i.At(x, y)))
+			}
+		}
+		return gray
+	}
+
+	if rgba, ok := i.(*image.RGBA); ok && rgba.Opaque() {
+		return rgba
+	}
+
+	bounds := i.Bounds()
+	rgba := image.NewRGBA(bounds)
+
+	if o, ok := i.(opaquer); ok && o.Opaque() {
+		draw.Draw(rgba, bounds, i, bounds.Min, draw.Src)
+		return rgba
+	}
+
+	draw.Draw(rgba, bounds, image.White, image.Point{}, draw.Src)
+	draw.Draw(rgba, bounds, i, bounds.Min, draw.Over)
+
+	return rgba
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Hand picked crops live next to the albums, keyed by photo name.
+const OverridesName = "overrides.json"
+
+// The darktable crop instance that marks the thumbnail. It's left
+// disabled so it doesn't change the export.
+const darktableThumbnailCrop = "thumbnail"
+
+// CropRect and FocalPoint are fractions of the exported image, so
+// they survive exporting at a different size.
+type CropRect struct {
+	Left   float64 `json:"left"`
+	Top    float64 `json:"top"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+type FocalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+type CropOverride struct {
+	Crop  *CropRect   `json:"crop,omitempty"`
+	Focus *FocalPoint `json:"focus,omitempty"`
+}
+
+func OpenOverrides(albumsRoot string) (map[string]*CropOverride, error) {
+	path := filepath.Join(albumsRoot, OverridesName)
+
+	overrides := make(map[string]*CropOverride)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return overrides, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &overrides)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for name, o := range overrides {
+		if o.Crop == nil && o.Focus == nil {
+			return nil, fmt.Errorf("%s: '%s' needs a crop or a focus", path, name)
+		}
+		if c := o.Crop; c != nil && (c.Width <= 0 || c.Height <= 0 || c.Left < 0 || c.Top < 0 || c.Left+c.Width > 1.000001 || c.Top+c.Height > 1.000001) {
+			return nil, fmt.Errorf("%s: '%s' crop should be within 0 and 1", path, name)
+		}
+		if f := o.Focus; f != nil && (f.X < 0 || f.X > 1 || f.Y < 0 || f.Y > 1) {
+			return nil, fmt.Errorf("%s: '%s' focus should be within 0 and 1", path, name)
+		}
+	}
+
+	return overrides, nil
+}
+
+// Returns the override for a photo, from the overrides file or from a
+// thumbnail crop in darktable. Every derivative asks, so the answer is
+// remembered rather than reading the photo's XMP again.
+func (g *Generator) CropOverride(source string) *CropOverride {
+	if o, ok := g.cropOverrides[source]; ok {
+		return o
+	}
+
+	return g.findCropOverride(source, func() *XmpFile {
+		xmp, _, err := g.Cache.FindMetadata(derivativeName(source))
+		if err != nil {
+			return nil
+		}
+		return xmp
+	})
+}
+
+// Like CropOverride, for a photo whose XMP is already loaded.
+func (g *Generator) CropOverrideFrom(source string, xmp *XmpFile) *CropOverride {
+	if o, ok := g.cropOverrides[source]; ok {
+		return o
+	}
+
+	return g.findCropOverride(source, func() *XmpFile {
+		return xmp
+	})
+}
+
+func (g *Generator) findCropOverride(source string, metadata func() *XmpFile) *CropOverride {
+	var override *CropOverride
+
+	name := derivativeName(source)
+	for _, key := range []string{name, removeAllExtensions(name)} {
+		if o, ok := g.Overrides[key]; ok {
+			override = o
+			break
+		}
+	}
+
+	if override == nil {
+		if xmp := metadata(); xmp != nil {
+			if crop := darktableThumbnail(xmp); crop != nil {
+				override = &CropOverride{Crop: crop}
+			}
+		}
+	}
+
+	if g.cropOverrides == nil {
+		g.cropOverrides = make(map[string]*CropOverride)
+	}
+	g.cropOverrides[source] = override
+
+	return override
+}
+
+// darktable's crop parameters, the edges as fractions of the image
+// coming into the module.
+type darktableCrop struct {
+	Left   float32
+	Top    float32
+	Right  float32
+	Bottom float32
+}
+
+// History params are hex, or zlib and base64 behind a "gz" and two
+// digits when darktable decided they were worth compressing.
+func decodeDarktableParams(params string) ([]byte, error) {
+	if !strings.HasPrefix(params, "gz") {
+		return hex.DecodeString(params)
+	}
+
+	if len(params) < 4 {
+		return nil, fmt.Errorf("malformed params")
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(params[4:])
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func parseDarktableCrop(params string) (*darktableCrop, error) {
+	data, err := decodeDarktableParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	crop := &darktableCrop{}
+	err = binary.Read(bytes.NewReader(data), binary.LittleEndian, crop)
+	if err != nil {
+		return nil, err
+	}
+
+	return crop, nil
+}
+
+// Finds a disabled crop instance named thumbnail and maps it through
+// the enabled crop, into the coordinates of the export.
+func darktableThumbnail(xmp *XmpFile) *CropRect {
+	var thumbnail, applied *darktableCrop
+
+	for _, h := range latestHistory(&xmp.Rdf.Description) {
+		if h.Operation != "crop" {
+			continue
+		}
+
+		crop, err := parseDarktableCrop(h.Params)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case h.MultiName == darktableThumbnailCrop && h.Enabled == 0:
+			thumbnail = crop
+		case h.Enabled != 0:
+			applied = crop
+		}
+	}
+
+	if thumbnail == nil {
+		return nil
+	}
+
+	if applied == nil {
+		applied = &darktableCrop{Right: 1, Bottom: 1}
+	}
+
+	width := float64(applied.Right - applied.Left)
+	height := float64(applied.Bottom - applied.Top)
+	if width <= 0 || height <= 0 {
+		return nil
+	}
+
+	clamp := func(v float64) float64 {
+		return math.Max(0, math.Min(1, v))
+	}
+
+	left := clamp(float64(thumbnail.Left-applied.Left) / width)
+	top := clamp(float64(thumbnail.Top-applied.Top) / height)
+	right := clamp(float64(thumbnail.Right-applied.Left) / width)
+	bottom := clamp(float64(thumbnail.Bottom-applied.Top) / height)
+
+	if right <= left || bottom <= top {
+		return nil
+	}
+
+	return &CropRect{Left: left, Top: top, Width: right - left, Height: bottom - top}
+}
+
+// The point to keep in view, the middle of the crop if there's no
+// explicit focus.
+func (o *CropOverride) FocalPoint() *FocalPoint {
+	if o.Focus != nil {
+		return o.Focus
+	}
+	return &FocalPoint{
+		X: o.Crop.Left + o.Crop.Width/2,
+		Y: o.Crop.Top + o.Crop.Height/2,
+	}
+}
+
+// The largest width by height shaped rectangle within the override's
+// crop, or the whole image, as close to the focal point as it fits.
+func (o *CropOverride) Rectangle(bounds image.Rectangle, width, height int) image.Rectangle {
+	dx, dy := float64(bounds.Dx()), float64(bounds.Dy())
+
+	region := [4]float64{0, 0, dx, dy}
+	if o.Crop != nil {
+		region = [4]float64{o.Crop.Left * dx, o.Crop.Top * dy, (o.Crop.Left + o.Crop.Width) * dx, (o.Crop.Top + o.Crop.Height) * dy}
+	}
+
+	ratio := float64(width) / float64(height)
+	w := math.Min(region[2]-region[0], (region[3]-region[1])*ratio)
+	h := w / ratio
+
+	focus := o.FocalPoint()
+	x := math.Max(region[0], math.Min(region[2]-w, focus.X*dx-w/2))
+	y := math.Max(region[1], math.Min(region[3]-h, focus.Y*dy-h/2))
+
+	return image.Rect(int(x), int(y), int(x+w), int(y+h)).Add(bounds.Min).Intersect(bounds)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// AlbumPage places one page of a paginated album among the others.
+// Pages are named like the album's path, the first keeps it and the
+// rest get a number after it.
+type AlbumPage struct {
+	Number   int
+	Pages    int
+	Name     string
+	Previous string
+	Next     string
+}
+
+// AlbumPageMap says which page every photo of an album is on, so
+// links to a photo can find it.
+type AlbumPageMap struct {
+	Pages  []string       `json:"pages"`
+	Photos map[string]int `json:"photos"`
+}
+
+func pageName(album *Album, number int) string {
+	if number <= 1 {
+		return album.Config.PathName
+	}
+	return fmt.Sprintf("%s-page-%d", album.Config.PathName, number)
+}
+
+// The name of the album's markdown and json files.
+func (a *Album) PageName() string {
+	if a.Page != nil {
+		return a.Page.Name
+	}
+	return a.Config.PathName
+}
+
+// Splits an album into pages of its page size in album order, so the
+// same photos always end up on the same page, and lays out each page.
+// Albums that fit on one page come back as they are.
+func (g *Generator) Paginate(album *Album) []*Album {
+	size := album.Config.PageSize
+	if size <= 0 || len(album.Files) <= size {
+		if g.Config.Layout != nil {
+			album.Layouts = g.Layouts(album.Files)
+		}
+		return []*Album{album}
+	}
+
+	count := (len(album.Files) + size - 1) / size
+
+	pages := make([]*Album, 0, count)
+	for number := 1; number <= count; number++ {
+		page := *album
+		page.Files = album.Files[(number-1)*size : min(number*size, len(album.Files))]
+		page.Page = &AlbumPage{
+			Number: number,
+			Pages:  count,
+			Name:   pageName(album, number),
+		}
+		if number > 1 {
+			page.Page.Previous = pageName(album, number-1)
+		}
+		if number < count {
+			page.Page.Next = pageName(album, number+1)
+		}
+		if g.Config.Layout != nil {
+			page.Layouts = g.Layouts(page.Files)
+		}
+		pages = append(pages, &page)
+	}
+
+	return pages
+}
+
+// Writes a page's json, and its markdown if it doesn't have any yet.
+func (g *Generator) WritePage(page *Album) error {
+	mdPath := filepath.Join(g.AlbumsRoot, fmt.Sprintf("%s.md", page.PageName()))
+	err := g.MarkDown(page, mdPath, "album.md.template", false)
+	if err != nil {
+		return err
+	}
+
+	err = UpdateFrontMatter(mdPath, g.FrontMatter(page))
+	if err != nil {
+		return err
+	}
+
+	jsonPath := filepath.Join(g.AlbumsRoot, fmt.Sprintf("%s.gallery.json", page.PageName()))
+	err = g.Json(page, jsonPath)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Writes where every photo is for paginated albums, and tidies up
+// after pages the album no longer has. Markdown is only ever reported
+// since it may have been edited.
+func (g *Generator) WritePageMap(album *Album, pages []*Album) error {
+	mapPath := filepath.Join(g.AlbumsRoot, fmt.Sprintf("%s.pages.json", album.Config.PathName))
+
+	if len(pages) > 1 {
+		pageMap := &AlbumPageMap{
+			Photos: make(map[string]int),
+		}
+		for _, page := range pages {
+			pageMap.Pages = append(pageMap.Pages, page.Page.Name)
+			for _, af := range page.Files {
+				pageMap.Photos[af.Name] = page.Page.Number
+			}
+		}
+
+		data, err := json.Marshal(pageMap)
+		if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(mapPath, data, 0644)
+		if err != nil {
+			return err
+		}
+	} else if err := os.Remove(mapPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for number := len(pages) + 1; ; number++ {
+		name := pageName(album, number)
+
+		err := os.Remove(filepath.Join(g.AlbumsRoot, fmt.Sprintf("%s.gallery.json", name)))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		mdPath := filepath.Join(g.AlbumsRoot, fmt.Sprintf("%s.md", name))
+		if _, err := os.Stat(mdPath); err == nil {
+			log.Printf("'%s' has no page %d any more, leaving %s", album.Config.Title, number, mdPath)
+		}
+	}
+
+	return nil
+}
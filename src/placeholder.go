@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"os"
+	"strings"
+)
+
+// Placeholder is what the site shows while a photo loads.
+type Placeholder struct {
+	BlurHash string
+	Average  string
+	Dominant string
+	Lqip     string
+}
+
+const (
+	blurHashX = 4
+	blurHashY = 3
+
+	// Everything is worked out from a small copy, none of these need
+	// more detail than this.
+	placeholderSize = 64
+	lqipSize        = 16
+	lqipQuality     = 50
+)
+
+// Placeholders are remembered in the manifest per source, so photos
+// whose derivatives are current don't need decoding again.
+func (g *Generator) Placeholder(source string) (*Placeholder, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+
+	record := g.Manifest.Source(source, info)
+	if record.Placeholder != nil {
+		return record.Placeholder, nil
+	}
+
+	i, err := g.Cache.Load(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := NewPlaceholder(i, g.Cache.Images.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	record.Placeholder = p
+
+	return p, nil
+}
+
+// Browsers paint placeholders as sRGB, so the small copies are
+// converted from the photo's profile first, as for teasers.
+func NewPlaceholder(i image.Image, profile *IccProfile) (*Placeholder, error) {
+	bounds := i.Bounds()
+	resizer := (&ProfileConfig{Filter: "bilinear"}).Resizer()
+
+	resize := func(width, height uint) image.Image {
+		converted, _, _ := manageColor(resizer.Resize(i, width, height), profile, ColorConvert)
+		return converted
+	}
+
+	small := image.NewRGBA(image.Rect(0, 0, placeholderSize, placeholderSize))
+	draw.Draw(small, small.Bounds(), resize(placeholderSize, placeholderSize), image.Point{}, draw.Src)
+
+	lqipWidth, lqipHeight := (&ProfileConfig{Width: lqipSize, Height: lqipSize, Fit: FitFit, Upscale: true}).Dimensions(uint(bounds.Dx()), uint(bounds.Dy()))
+	lqip, err := encodeJpeg(resize(lqipWidth, lqipHeight), lqipQuality)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Placeholder{
+		BlurHash: blurHash(small, blurHashX, blurHashY),
+		Average:  averageColor(small),
+		Dominant: dominantColor(small),
+		Lqip:     "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(lqip),
+	}, nil
+}
+
+func hexColor(r, g, b float64) string {
+	return fmt.Sprintf("#%02x%02x%02x", uint8(math.Round(r)), uint8(math.Round(g)), uint8(math.Round(b)))
+}
+
+func averageColor(i *image.RGBA) string {
+	var r, g, b float64
+	n := float64(len(i.Pix) / 4)
+	for p := 0; p < len(i.Pix); p += 4 {
+		r += float64(i.Pix[p])
+		g += float64(i.Pix[p+1])
+		b += float64(i.Pix[p+2])
+	}
+	return hexColor(r/n, g/n, b/n)
+}
+
+// The average of the most common 4 bit per channel bucket, which
+// is close to what people would call the photo's color.
+func dominantColor(i *image.RGBA) string {
+	type bucket struct {
+		count   int
+		r, g, b float64
+	}
+
+	buckets := make(map[int]*bucket)
+	var best *bucket
+	for p := 0; p < len(i.Pix); p += 4 {
+		key := int(i.Pix[p]>>4)<<8 | int(i.Pix[p+1]>>4)<<4 | int(i.Pix[p+2]>>4)
+		b, ok := buckets[key]
+		if !ok {
+			b = &bucket{}
+			buckets[key] = b
+		}
+		b.count++
+		b.r += float64(i.Pix[p])
+		b.g += float64(i.Pix[p+1])
+		b.b += float64(i.Pix[p+2])
+		if best == nil || b.count > best.count {
+			best = b
+		}
+	}
+
+	n := float64(best.count)
+	return hexColor(best.r/n, best.g/n, best.b/n)
+}
+
+const blurHashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encodeBase83(value, length int) string {
+	encoded := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		encoded[i] = blurHashCharacters[value%83]
+		value /= 83
+	}
+	return string(encoded)
+}
+
+func signPow(value, exponent float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exponent), value)
+}
+
+// https://github.com/woltapp/blurhash/blob/master/Algorithm.md
+func blurHash(i *image.RGBA, componentsX, componentsY int) string {
+	width, height := i.Bounds().Dx(), i.Bounds().Dy()
+
+	linear := make([][3]float64, width*height)
+	for p := range linear {
+		for c := 0; c < 3; c++ {
+			linear[p][c] = srgbToLinear(float64(i.Pix[p*4+c]) / 255)
+		}
+	}
+
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for cy := 0; cy < componentsY; cy++ {
+		for cx := 0; cx < componentsX; cx++ {
+			normalization := 2.0
+			if cx == 0 && cy == 0 {
+				normalization = 1
+			}
+			factor := [3]float64{}
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalization *
+						math.Cos(math.Pi*float64(cx)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(cy)*float64(y)/float64(height))
+					for c := 0; c < 3; c++ {
+						factor[c] += basis * linear[y*width+x][c]
+					}
+				}
+			}
+			scale := 1 / float64(width*height)
+			for c := 0; c < 3; c++ {
+				factor[c] *= scale
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	hash := &strings.Builder{}
+	hash.WriteString(encodeBase83((componentsX-1)+(componentsY-1)*9, 1))
+
+	maximum := 0.0
+	for _, factor := range factors[1:] {
+		for _, v := range factor {
+			maximum = math.Max(maximum, math.Abs(v))
+		}
+	}
+
+	quantized := 0
+	if len(factors) > 1 {
+		quantized = int(math.Max(0, math.Min(82, math.Floor(maximum*166-0.5))))
+		maximum = float64(quantized+1) / 166
+	} else {
+		maximum = 1
+	}
+	hash.WriteString(encodeBase83(quantized, 1))
+
+	dc := factors[0]
+	toSrgb := func(v float64) int {
+		return int(math.Round(math.Max(0, math.Min(1, linearToSrgb(v))) * 255))
+	}
+	hash.WriteString(encodeBase83(toSrgb(dc[0])<<16|toSrgb(dc[1])<<8|toSrgb(dc[2]), 4))
+
+	for _, factor := range factors[1:] {
+		q := [3]int{}
+		for c, v := range factor {
+			q[c] = int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(q[0]*19*19+q[1]*19+q[2], 2))
+	}
+
+	return hash.String()
+}
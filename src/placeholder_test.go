@@ -0,0 +1,83 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"testing"
+)
+
+func solidImage(c color.RGBA, width, height int) *image.RGBA {
+	i := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(i, i.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return i
+}
+
+// Expected hashes are from a port of the reference encoder. Even flat
+// images have a little AC, the reference sums its cosines over whole
+// pixels.
+func TestBlurHash(t *testing.T) {
+	gradient := image.NewRGBA(image.Rect(0, 0, 16, 12))
+	halves := solidImage(color.RGBA{0, 0, 0, 255}, 16, 12)
+	for y := 0; y < 12; y++ {
+		for x := 0; x < 16; x++ {
+			gradient.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 20), uint8(255 - x*16), 255})
+		}
+	}
+	draw.Draw(halves, image.Rect(0, 0, 8, 12), image.White, image.Point{}, draw.Src)
+
+	tests := []struct {
+		name     string
+		image    *image.RGBA
+		expected string
+	}{
+		{"black", solidImage(color.RGBA{0, 0, 0, 255}, 16, 12), "L00000fQfQfQfQfQfQfQfQfQfQfQ"},
+		{"white", solidImage(color.RGBA{255, 255, 255, 255}, 16, 12), "LRTSUA_3fQ_3~qoffQoffQfQfQfQ"},
+		{"red", solidImage(color.RGBA{255, 0, 0, 255}, 16, 12), "LRTI:j]9fQ]9|co1fQo1fQfQfQfQ"},
+		{"blue grey", solidImage(color.RGBA{18, 52, 86, 255}, 16, 12), "L227F4p1fQp1pLj]fQj]fQfQfQfQ"},
+		{"gradient", gradient, "L[GuUy77sakFq+WGjve=f%fjfQfj"},
+		{"bright left half", halves, "L~Lqe9~q%MIUxut7j[ayfQfQfQfQ"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hash := blurHash(test.image, blurHashX, blurHashY)
+			if hash != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, hash)
+			}
+		})
+	}
+}
+
+func TestBlurHashComponents(t *testing.T) {
+	tests := []struct {
+		x, y   int
+		length int
+		size   string
+	}{
+		{1, 1, 6, "0"},
+		{4, 3, 28, "L"},
+		{9, 9, 6 + 2*80, "|"},
+	}
+
+	for _, test := range tests {
+		hash := blurHash(solidImage(color.RGBA{128, 128, 128, 255}, 8, 8), test.x, test.y)
+		if len(hash) != test.length || hash[:1] != test.size {
+			t.Fatalf("%dx%d: expected %d characters starting %s, got %s", test.x, test.y, test.length, test.size, hash)
+		}
+	}
+}
+
+func TestNewPlaceholderWithoutProfile(t *testing.T) {
+	p, err := NewPlaceholder(solidImage(color.RGBA{18, 52, 86, 255}, 100, 50), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Average != "#123456" || p.Dominant != "#123456" {
+		t.Fatalf("unexpected colors %s %s", p.Average, p.Dominant)
+	}
+	if !strings.HasPrefix(p.Lqip, "data:image/jpeg;base64,") {
+		t.Fatalf("unexpected lqip %s", p.Lqip)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type PlacesConfig struct {
+	Cities      string  `json:"cities"`
+	Admin1      string  `json:"admin1"`
+	Countries   string  `json:"countries"`
+	MaxDistance float64 `json:"max_distance"`
+}
+
+type Place struct {
+	City        string
+	Region      string
+	Country     string
+	CountryCode string
+	Distance    float64
+
+	asciiName string
+}
+
+type GeoName struct {
+	Name        string
+	AsciiName   string
+	Latitude    float64
+	Longitude   float64
+	CountryCode string
+	Admin1Code  string
+}
+
+type gridCell struct {
+	Latitude  int
+	Longitude int
+}
+
+// Gazetteer answers nearest city queries against a GeoNames dump,
+// bucketing cities into one degree cells so that a lookup only has to
+// consider the cells near the photo.
+type Gazetteer struct {
+	Cells       map[gridCell][]*GeoName
+	Regions     map[string]string
+	Countries   map[string]string
+	MaxDistance float64
+}
+
+const earthRadiusKm = 6371.0
+
+func openTabSeparated(path string, fn func(fields []string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(strings.Split(line, "\t")); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func NewGazetteer(cfg *PlacesConfig) (*Gazetteer, error) {
+	gz := &Gazetteer{
+		Cells:       make(map[gridCell][]*GeoName),
+		Regions:     make(map[string]string),
+		Countries:   make(map[string]string),
+		MaxDistance: 50,
+	}
+
+	if cfg.MaxDistance > 0 {
+		gz.MaxDistance = cfg.MaxDistance
+	}
+
+	total := 0
+
+	// See http://download.geonames.org/export/dump/readme.txt for the
+	// column layout, cities1000.txt is a good size for this.
+	err := openTabSeparated(cfg.Cities, func(fields []string) error {
+		if len(fields) < 11 {
+			return fmt.Errorf("malformed city: %v", fields)
+		}
+
+		latitude, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			return err
+		}
+
+		longitude, err := strconv.ParseFloat(fields[5], 64)
+		if err != nil {
+			return err
+		}
+
+		gn := &GeoName{
+			Name:        fields[1],
+			AsciiName:   fields[2],
+			Latitude:    latitude,
+			Longitude:   longitude,
+			CountryCode: fields[8],
+			Admin1Code:  fields[10],
+		}
+
+		cell := cellOf(latitude, longitude)
+		gz.Cells[cell] = append(gz.Cells[cell], gn)
+		total++
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Admin1 != "" {
+		err := openTabSeparated(cfg.Admin1, func(fields []string) error {
+			if len(fields) < 2 {
+				return fmt.Errorf("malformed region: %v", fields)
+			}
+			gz.Regions[fields[0]] = fields[1]
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Countries != "" {
+		err := openTabSeparated(cfg.Countries, func(fields []string) error {
+			if len(fields) < 5 {
+				return fmt.Errorf("malformed country: %v", fields)
+			}
+			gz.Countries[fields[0]] = fields[4]
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("loaded %d places from %s", total, cfg.Cities)
+
+	return gz, nil
+}
+
+func cellOf(latitude, longitude float64) gridCell {
+	return gridCell{
+		Latitude:  int(math.Floor(latitude)),
+		Longitude: int(math.Floor(longitude)),
+	}
+}
+
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	toRadians := math.Pi / 180
+	dLat := (lat2 - lat1) * toRadians
+	dLon := (lon2 - lon1) * toRadians
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRadians)*math.Cos(lat2*toRadians)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+func (gz *Gazetteer) Lookup(l *Location) *Place {
+	if l == nil {
+		return nil
+	}
+
+	// A degree of latitude is roughly 111km everywhere, a degree of
+	// longitude shrinks towards the poles so we search wider there.
+	latitudeCells := int(math.Ceil(gz.MaxDistance / 111))
+	longitudeCells := 180
+	if c := math.Cos(l.Latitude * math.Pi / 180); c > 0.01 {
+		longitudeCells = int(math.Ceil(gz.MaxDistance / (111 * c)))
+	}
+	if longitudeCells > 180 {
+		longitudeCells = 180
+	}
+
+	center := cellOf(l.Latitude, l.Longitude)
+
+	var nearest *GeoName
+	nearestDistance := 0.0
+
+	for dy := -latitudeCells; dy <= latitudeCells; dy++ {
+		for dx := -longitudeCells; dx <= longitudeCells; dx++ {
+			longitude := center.Longitude + dx
+			// Wrap around the antimeridian.
+			longitude = ((longitude+180)%360+360)%360 - 180
+			cell := gridCell{Latitude: center.Latitude + dy, Longitude: longitude}
+			for _, gn := range gz.Cells[cell] {
+				d := haversine(l.Latitude, l.Longitude, gn.Latitude, gn.Longitude)
+				if nearest == nil || d < nearestDistance {
+					nearest = gn
+					nearestDistance = d
+				}
+			}
+		}
+	}
+
+	if nearest == nil || nearestDistance > gz.MaxDistance {
+		return nil
+	}
+
+	place := &Place{
+		City:        nearest.Name,
+		Region:      gz.Regions[nearest.CountryCode+"."+nearest.Admin1Code],
+		Country:     gz.Countries[nearest.CountryCode],
+		CountryCode: nearest.CountryCode,
+		Distance:    nearestDistance,
+		asciiName:   nearest.AsciiName,
+	}
+
+	if place.Country == "" {
+		place.Country = nearest.CountryCode
+	}
+
+	if verbose {
+		log.Printf("place: %v -> %s (%.1fkm)", *l, nearest.AsciiName, nearestDistance)
+	}
+
+	return place
+}
+
+func placeSlug(s string) string {
+	return strings.Replace(strings.ToLower(strings.TrimSpace(s)), " ", "-", -1)
+}
+
+// These are the automatic tags a place contributes to album
+// selection, for example place|fr and place|fr|paris.
+func (p *Place) Tags() []string {
+	if p == nil {
+		return nil
+	}
+
+	country := placeSlug(p.CountryCode)
+	return []string{
+		"place|" + country,
+		"place|" + country + "|" + placeSlug(p.asciiName),
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeGeoNames(t *testing.T, dir, name string, rows ...[]string) string {
+	t.Helper()
+
+	lines := []string{"# comments are skipped"}
+	for _, row := range rows {
+		lines = append(lines, strings.Join(row, "\t"))
+	}
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func geoNamesCity(id, name, ascii, latitude, longitude, country, admin1 string) []string {
+	return []string{id, name, ascii, "", latitude, longitude, "P", "PPL", country, "", admin1}
+}
+
+func testGazetteer(t *testing.T) *Gazetteer {
+	dir := t.TempDir()
+
+	gz, err := NewGazetteer(&PlacesConfig{
+		Cities: writeGeoNames(t, dir, "cities.txt",
+			geoNamesCity("2988507", "Paris", "Paris", "48.85341", "2.3488", "FR", "11"),
+			geoNamesCity("2996944", "Lyon", "Lyon", "45.74846", "4.84671", "FR", "84"),
+			geoNamesCity("3003603", "Le Mans", "Le Mans", "48.0", "0.2", "FR", "52"),
+			geoNamesCity("2198148", "Levuka", "Levuka", "-17.68", "179.95", "FJ", "01"),
+			geoNamesCity("3413829", "Longyearbyen", "Longyearbyen", "78.22", "15.64", "SJ", "")),
+		Admin1: writeGeoNames(t, dir, "admin1.txt",
+			[]string{"FR.11", "Île-de-France"},
+			[]string{"FR.84", "Auvergne-Rhône-Alpes"}),
+		Countries: writeGeoNames(t, dir, "countries.txt",
+			[]string{"FR", "FRA", "250", "FR", "France"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gz
+}
+
+func TestGazetteerLookup(t *testing.T) {
+	gz := testGazetteer(t)
+
+	tests := []struct {
+		name     string
+		location *Location
+		expected *Place
+	}{
+		{"no location", nil, nil},
+		{"central paris", &Location{Latitude: 48.86, Longitude: 2.35}, &Place{City: "Paris", Region: "Île-de-France", Country: "France", CountryCode: "FR"}},
+		{"across a cell boundary", &Location{Latitude: 47.99, Longitude: 0.21}, &Place{City: "Le Mans", Country: "France", CountryCode: "FR"}},
+		{"nearest wins", &Location{Latitude: 45.8, Longitude: 4.8}, &Place{City: "Lyon", Region: "Auvergne-Rhône-Alpes", Country: "France", CountryCode: "FR"}},
+		{"too far from anywhere", &Location{Latitude: 47, Longitude: 3}, nil},
+		{"across the antimeridian", &Location{Latitude: -17.7, Longitude: -179.9}, &Place{City: "Levuka", Country: "FJ", CountryCode: "FJ"}},
+		{"near the pole", &Location{Latitude: 78.3, Longitude: 17}, &Place{City: "Longyearbyen", Country: "SJ", CountryCode: "SJ"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			place := gz.Lookup(test.location)
+			if test.expected == nil || place == nil {
+				if test.expected != place {
+					t.Fatalf("expected %+v, got %+v", test.expected, place)
+				}
+				return
+			}
+			if place.Distance > gz.MaxDistance {
+				t.Fatalf("%s is %.1fkm away", place.City, place.Distance)
+			}
+			place.Distance, place.asciiName = 0, ""
+			if *place != *test.expected {
+				t.Fatalf("expected %+v, got %+v", test.expected, place)
+			}
+		})
+	}
+}
+
+func TestHaversine(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		expected               float64
+	}{
+		{"same point", 48.85, 2.35, 48.85, 2.35, 0},
+		{"paris to lyon", 48.85341, 2.3488, 45.74846, 4.84671, 393},
+		{"a degree along the equator", 0, 0, 0, 1, 111.2},
+		{"across the antimeridian", 0, 179.5, 0, -179.5, 111.2},
+	}
+
+	for _, test := range tests {
+		if d := haversine(test.lat1, test.lon1, test.lat2, test.lon2); d < test.expected-1 || d > test.expected+1 {
+			t.Fatalf("%s: expected about %vkm, got %v", test.name, test.expected, d)
+		}
+	}
+}
+
+func TestPlaceTags(t *testing.T) {
+	place := &Place{CountryCode: "FR", asciiName: "Le Mans"}
+	expected := []string{"place|fr", "place|fr|le-mans"}
+	if tags := place.Tags(); !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("expected %v, got %v", expected, tags)
+	}
+
+	if (*Place)(nil).Tags() != nil {
+		t.Fatalf("expected no tags without a place")
+	}
+}
+
+func TestNewGazetteerMalformed(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name string
+		row  []string
+	}{
+		{"short", []string{"1", "Paris"}},
+		{"latitude", geoNamesCity("1", "Paris", "Paris", "north", "2.3488", "FR", "11")},
+	}
+
+	for _, test := range tests {
+		cities := writeGeoNames(t, dir, test.name+".txt", test.row)
+		if _, err := NewGazetteer(&PlacesConfig{Cities: cities}); err == nil {
+			t.Fatalf("%s: expected an error", test.name)
+		}
+	}
+}
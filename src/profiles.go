@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/muesli/smartcrop/nfnt"
+	"github.com/muesli/smartcrop/options"
+	"github.com/nfnt/resize"
+)
+
+const (
+	ProfileThumbnail = "thumbnail"
+	ProfileSmall     = "small"
+	ProfileLarge     = "large"
+	ProfileCover     = "cover"
+	ProfileSocial    = "social"
+	ProfilePrint     = "print"
+)
+
+// What to do with the source's ICC profile. Converting to sRGB is the
+// only thing every browser gets right, embedding keeps the original
+// gamut for the ones that do color management.
+const (
+	ColorConvert = "convert"
+	ColorEmbed   = "embed"
+	ColorNone    = "none"
+)
+
+// How a derivative is sized to its box. Fit keeps the whole photo
+// inside the box, fill covers it and crops what's left over, width
+// only looks at the width.
+const (
+	FitFit   = "fit"
+	FitFill  = "fill"
+	FitWidth = "width"
+)
+
+// Resampling kernels, bicubic is what we always used before they
+// were configurable.
+var resamplingFilters = map[string]resize.InterpolationFunction{
+	"bilinear": resize.Bilinear,
+	"bicubic":  resize.Bicubic,
+	"mitchell": resize.MitchellNetravali,
+	"lanczos2": resize.Lanczos2,
+	"lanczos3": resize.Lanczos3,
+}
+
+const DefaultResamplingFilter = "bicubic"
+
+// ProfileConfig controls how one kind of derivative is produced.
+// Thumbnails are always square crops of ThumbnailSizes, so they
+// ignore the size settings.
+type ProfileConfig struct {
+	Color    string   `json:"color"`
+	Metadata []string `json:"metadata"`
+	Width    uint     `json:"width"`
+	Height   uint     `json:"height"`
+	Fit      string   `json:"fit"`
+	Upscale  bool     `json:"upscale"`
+
+	Filter  string         `json:"filter"`
+	Sharpen *SharpenConfig `json:"sharpen"`
+
+	Quality    int     `json:"quality"`
+	MinQuality int     `json:"min_quality"`
+	MaxQuality int     `json:"max_quality"`
+	MaxBytes   int     `json:"max_bytes"`
+	TargetSSIM float64 `json:"target_ssim"`
+}
+
+var profileNames = []string{ProfileThumbnail, ProfileSmall, ProfileLarge, ProfileCover, ProfileSocial, ProfilePrint}
+
+var DefaultProfileSizes = map[string][2]uint{
+	ProfileSmall:  {320, 240},
+	ProfileLarge:  {1600, 1200},
+	ProfileCover:  {800, 600},
+	ProfileSocial: {1200, 630},
+	ProfilePrint:  {3600, 3600},
+}
+
+// Covers are cropped to their shape, everything else keeps the photo's.
+var DefaultProfileFits = map[string]string{
+	ProfileCover:  FitFill,
+	ProfileSocial: FitFill,
+}
+
+// Prints are looked at up close.
+var DefaultProfileQualities = map[string]int{
+	ProfilePrint: 92,
+}
+
+func (g *Generator) CheckProfiles() error {
+	for name, p := range g.Config.Profiles {
+		known := false
+		for _, n := range profileNames {
+			known = known || n == name
+		}
+		if !known {
+			return fmt.Errorf("unknown profile '%s'", name)
+		}
+
+		switch p.Color {
+		case "", ColorConvert, ColorEmbed, ColorNone:
+		default:
+			return fmt.Errorf("profile '%s': unknown color policy '%s'", name, p.Color)
+		}
+
+		// PDFs place JPEGs as plain RGB and drop their profiles.
+		if name == ProfilePrint && p.Color != "" && p.Color != ColorConvert {
+			return fmt.Errorf("profile '%s': books need prints converted to sRGB", name)
+		}
+
+		switch p.Fit {
+		case "", FitFit:
+		case FitFill:
+			if (p.Width == 0) != (p.Height == 0) {
+				return fmt.Errorf("profile '%s': fill needs a width and a height", name)
+			}
+		case FitWidth:
+			if p.Width == 0 && p.Height != 0 {
+				return fmt.Errorf("profile '%s': width fit needs a width", name)
+			}
+		default:
+			return fmt.Errorf("profile '%s': unknown fit '%s'", name, p.Fit)
+		}
+
+		if _, ok := resamplingFilters[p.Filter]; !ok && p.Filter != "" {
+			return fmt.Errorf("profile '%s': unknown filter '%s'", name, p.Filter)
+		}
+
+		if p.Sharpen != nil && (p.Sharpen.Radius <= 0 || p.Sharpen.Amount <= 0) {
+			return fmt.Errorf("profile '%s': sharpen needs a positive radius and amount", name)
+		}
+
+		for _, quality := range []int{p.Quality, p.MinQuality, p.MaxQuality} {
+			if quality < 0 || quality > 100 {
+				return fmt.Errorf("profile '%s': quality should be 0 for the default, or 1-100", name)
+			}
+		}
+
+		// Either bound may be the default, so compare what's searched.
+		effective := g.Profile(name)
+		if effective.MinQuality >= effective.MaxQuality {
+			return fmt.Errorf("profile '%s': min_quality %d should be below max_quality %d", name, effective.MinQuality, effective.MaxQuality)
+		}
+
+		if p.TargetSSIM < 0 || p.TargetSSIM >= 1 {
+			return fmt.Errorf("profile '%s': target_ssim should be between 0 and 1", name)
+		}
+
+		for _, field := range p.Metadata {
+			known := false
+			for _, f := range metadataFields {
+				known = known || f == field
+			}
+			if !known {
+				return fmt.Errorf("profile '%s': unknown metadata field '%s'", name, field)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the configured profile with defaults filled in.
+func (g *Generator) Profile(name string) *ProfileConfig {
+	p := &ProfileConfig{}
+	if configured, ok := g.Config.Profiles[name]; ok && configured != nil {
+		*p = *configured
+	}
+
+	if p.Color == "" {
+		p.Color = ColorConvert
+	}
+
+	if p.Width == 0 && p.Height == 0 {
+		size := DefaultProfileSizes[name]
+		p.Width, p.Height = size[0], size[1]
+	}
+
+	if p.Fit == "" {
+		p.Fit = DefaultProfileFits[name]
+	}
+	if p.Fit == "" {
+		p.Fit = FitFit
+	}
+
+	if p.Filter == "" {
+		p.Filter = DefaultResamplingFilter
+	}
+
+	if p.Quality == 0 {
+		p.Quality = DefaultProfileQualities[name]
+	}
+	if p.Quality == 0 {
+		p.Quality = DefaultJpegQuality
+	}
+	if p.MinQuality == 0 {
+		p.MinQuality = DefaultMinJpegQuality
+	}
+	if p.MaxQuality == 0 {
+		p.MaxQuality = DefaultMaxJpegQuality
+	}
+
+	// Only a missing list gets the default, an empty one writes nothing.
+	if p.Metadata == nil {
+		p.Metadata = DefaultProfileMetadata
+	}
+
+	return p
+}
+
+// Settings identify everything about a profile that changes the
+// pixels, derivatives made with different settings are regenerated.
+func (p *ProfileConfig) Settings() string {
+	data, err := json.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+// Returns the size of a derivative of a dx by dy image. A zero width
+// or height leaves that axis unbounded.
+func (p *ProfileConfig) Dimensions(dx, dy uint) (uint, uint) {
+	if dx == 0 || dy == 0 || (p.Width == 0 && p.Height == 0) {
+		return dx, dy
+	}
+
+	ox, oy := float64(dx), float64(dy)
+	w, h := float64(p.Width), float64(p.Height)
+
+	if p.Fit == FitFill {
+		scale := math.Max(w/ox, h/oy)
+		if scale > 1 && !p.Upscale {
+			// Keep the shape of the box, but no bigger than the
+			// photo allows.
+			shrink := math.Min(ox/w, oy/h)
+			return atLeastOne(w * shrink), atLeastOne(h * shrink)
+		}
+		return p.Width, p.Height
+	}
+
+	scale := math.Inf(1)
+	if p.Width != 0 {
+		scale = w / ox
+	}
+	if p.Fit == FitFit && p.Height != 0 {
+		scale = math.Min(scale, h/oy)
+	}
+	if scale > 1 && !p.Upscale {
+		scale = 1
+	}
+
+	return atLeastOne(ox * scale), atLeastOne(oy * scale)
+}
+
+func atLeastOne(v float64) uint {
+	if v < 1 {
+		return 1
+	}
+	return uint(math.Round(v))
+}
+
+func (p *ProfileConfig) Resizer() options.Resizer {
+	return nfnt.NewResizer(resamplingFilters[p.Filter])
+}
+
+// Resizes and then sharpens, if the profile asks for it.
+func (p *ProfileConfig) Resize(i image.Image, width, height uint) image.Image {
+	resized := p.Resizer().Resize(i, width, height)
+	if p.Sharpen != nil {
+		return unsharpMask(resized, p.Sharpen)
+	}
+	return resized
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestProfileDimensions(t *testing.T) {
+	tests := []struct {
+		name     string
+		profile  ProfileConfig
+		dx, dy   uint
+		expected [2]uint
+	}{
+		{"fit landscape", ProfileConfig{Width: 1600, Height: 1200, Fit: FitFit}, 6000, 4000, [2]uint{1600, 1067}},
+		{"fit portrait", ProfileConfig{Width: 1600, Height: 1200, Fit: FitFit}, 4000, 6000, [2]uint{800, 1200}},
+		{"fit never upscales", ProfileConfig{Width: 1600, Height: 1200, Fit: FitFit}, 800, 600, [2]uint{800, 600}},
+		{"fit upscales when asked", ProfileConfig{Width: 1600, Height: 1200, Fit: FitFit, Upscale: true}, 800, 600, [2]uint{1600, 1200}},
+		{"fit unbounded height", ProfileConfig{Width: 1000, Fit: FitFit}, 4000, 6000, [2]uint{1000, 1500}},
+		{"fill is the box", ProfileConfig{Width: 800, Height: 600, Fit: FitFill}, 6000, 4000, [2]uint{800, 600}},
+		{"fill small photo keeps the box shape", ProfileConfig{Width: 1200, Height: 630, Fit: FitFill}, 600, 900, [2]uint{600, 315}},
+		{"fill upscales when asked", ProfileConfig{Width: 1200, Height: 630, Fit: FitFill, Upscale: true}, 600, 900, [2]uint{1200, 630}},
+		{"width ignores height", ProfileConfig{Width: 1000, Height: 100, Fit: FitWidth}, 4000, 6000, [2]uint{1000, 1500}},
+		{"width never upscales", ProfileConfig{Width: 1000, Fit: FitWidth}, 500, 300, [2]uint{500, 300}},
+		{"panorama stays at least a pixel", ProfileConfig{Width: 100, Height: 100, Fit: FitFit}, 100000, 100, [2]uint{100, 1}},
+		{"no box", ProfileConfig{Fit: FitFit}, 640, 480, [2]uint{640, 480}},
+		{"empty image", ProfileConfig{Width: 100, Height: 100, Fit: FitFit}, 0, 480, [2]uint{0, 480}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, h := test.profile.Dimensions(test.dx, test.dy)
+			if w != test.expected[0] || h != test.expected[1] {
+				t.Fatalf("expected %v, got [%d %d]", test.expected, w, h)
+			}
+		})
+	}
+}
+
+func TestCheckProfiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile *ProfileConfig
+		valid   bool
+	}{
+		{"defaults", &ProfileConfig{}, true},
+		{"quality", &ProfileConfig{Quality: 90, MinQuality: 50, MaxQuality: 95}, true},
+		{"quality too high", &ProfileConfig{Quality: 101}, false},
+		{"min above max", &ProfileConfig{MinQuality: 90, MaxQuality: 80}, false},
+		{"min with the default max", &ProfileConfig{MinQuality: 60}, true},
+		{"min at the default max", &ProfileConfig{MinQuality: DefaultMaxJpegQuality}, false},
+		{"max below the default min", &ProfileConfig{MaxQuality: 30}, false},
+		{"min equal to max", &ProfileConfig{MinQuality: 70, MaxQuality: 70}, false},
+		{"fill needs both", &ProfileConfig{Fit: FitFill, Width: 100}, false},
+		{"unknown filter", &ProfileConfig{Filter: "box"}, false},
+		{"unknown metadata", &ProfileConfig{Metadata: []string{"gps"}}, false},
+		{"ssim out of range", &ProfileConfig{TargetSSIM: 1}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := &Generator{Config: &Configuration{Profiles: map[string]*ProfileConfig{ProfileLarge: test.profile}}}
+			err := g.CheckProfiles()
+			if (err == nil) != test.valid {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func TestCheckPrintColor(t *testing.T) {
+	tests := []struct {
+		color string
+		valid bool
+	}{
+		{"", true},
+		{ColorConvert, true},
+		{ColorEmbed, false},
+		{ColorNone, false},
+	}
+
+	for _, test := range tests {
+		g := &Generator{Config: &Configuration{Profiles: map[string]*ProfileConfig{ProfilePrint: {Color: test.color}}}}
+		err := g.CheckProfiles()
+		if (err == nil) != test.valid {
+			t.Fatalf("color '%s': expected valid %v, got %v", test.color, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+)
+
+const (
+	DefaultJpegQuality    = 80
+	DefaultMinJpegQuality = 40
+	DefaultMaxJpegQuality = 95
+)
+
+func encodeJpeg(i image.Image, quality int) ([]byte, error) {
+	encoded := &bytes.Buffer{}
+	err := jpeg.Encode(encoded, i, &jpeg.Options{Quality: quality})
+	if err != nil {
+		return nil, err
+	}
+	return encoded.Bytes(), nil
+}
+
+// Encodes at the profile's fixed quality, or searches for the one that
+// meets its targets. With a byte budget we want the highest quality
+// that fits and with a similarity target the lowest quality that
+// reaches it. When both are set the budget wins. The overhead is what
+// the segments we'll add take up.
+func (p *ProfileConfig) EncodeJpeg(i image.Image, overhead int) ([]byte, int, error) {
+	if p.MaxBytes == 0 && p.TargetSSIM == 0 {
+		data, err := encodeJpeg(i, p.Quality)
+		return data, p.Quality, err
+	}
+
+	encodings := make(map[int][]byte)
+	encode := func(quality int) ([]byte, error) {
+		if data, ok := encodings[quality]; ok {
+			return data, nil
+		}
+		data, err := encodeJpeg(i, quality)
+		if err != nil {
+			return nil, err
+		}
+		encodings[quality] = data
+		return data, nil
+	}
+
+	low, high := p.MinQuality, p.MaxQuality
+
+	if p.TargetSSIM > 0 {
+		reference := lumaPlane(i)
+		found := high
+		for lo, hi := low, high; lo <= hi; {
+			quality := (lo + hi) / 2
+			data, err := encode(quality)
+			if err != nil {
+				return nil, 0, err
+			}
+			decoded, err := jpeg.Decode(bytes.NewReader(data))
+			if err != nil {
+				return nil, 0, err
+			}
+			if ssim(reference, lumaPlane(decoded)) >= p.TargetSSIM {
+				found = quality
+				hi = quality - 1
+			} else {
+				lo = quality + 1
+			}
+		}
+		high = found
+	}
+
+	chosen := high
+
+	if p.MaxBytes > 0 {
+		chosen = -1
+		for lo, hi := low, high; lo <= hi; {
+			quality := (lo + hi) / 2
+			data, err := encode(quality)
+			if err != nil {
+				return nil, 0, err
+			}
+			if len(data)+overhead <= p.MaxBytes {
+				chosen = quality
+				lo = quality + 1
+			} else {
+				hi = quality - 1
+			}
+		}
+		if chosen < 0 {
+			log.Printf("unable to fit in %d bytes, using quality %d", p.MaxBytes, low)
+			chosen = low
+		}
+	}
+
+	data, err := encode(chosen)
+	return data, chosen, err
+}
+
+type plane struct {
+	Width  int
+	Height int
+	Pix    []float64
+}
+
+func lumaPlane(i image.Image) *plane {
+	bounds := i.Bounds()
+	p := &plane{
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+		Pix:    make([]float64, bounds.Dx()*bounds.Dy()),
+	}
+	for y := 0; y < p.Height; y++ {
+		for x := 0; x < p.Width; x++ {
+			gray := color.GrayModel.Convert(i.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray)
+			p.Pix[y*p.Width+x] = float64(gray.Y)
+		}
+	}
+	return p
+}
+
+// Mean structural similarity of two luma planes over 8x8 windows,
+// stepping by 4. Good enough to compare encodings of the same image.
+func ssim(a, b *plane) float64 {
+	const (
+		window = 8
+		step   = 4
+		c1     = (0.01 * 255) * (0.01 * 255)
+		c2     = (0.03 * 255) * (0.03 * 255)
+	)
+
+	if a.Width < window || a.Height < window {
+		return 1
+	}
+
+	total, count := 0.0, 0
+	for y := 0; y+window <= a.Height; y += step {
+		for x := 0; x+window <= a.Width; x += step {
+			var sa, sb, saa, sbb, sab float64
+			for wy := 0; wy < window; wy++ {
+				for wx := 0; wx < window; wx++ {
+					va := a.Pix[(y+wy)*a.Width+x+wx]
+					vb := b.Pix[(y+wy)*b.Width+x+wx]
+					sa += va
+					sb += vb
+					saa += va * va
+					sbb += vb * vb
+					sab += va * vb
+				}
+			}
+			n := float64(window * window)
+			ma, mb := sa/n, sb/n
+			va, vb := saa/n-ma*ma, sbb/n-mb*mb
+			cov := sab/n - ma*mb
+			total += ((2*ma*mb + c1) * (2*cov + c2)) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+			count++
+		}
+	}
+
+	return total / float64(count)
+}
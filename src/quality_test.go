@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// Detailed enough that every quality step changes the encoding.
+func noisyImage(width, height int) *image.RGBA {
+	i := image.NewRGBA(image.Rect(0, 0, width, height))
+	seed := uint32(1)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			seed = seed*1664525 + 1013904223
+			noise := uint8(seed >> 27)
+			i.Set(x, y, color.RGBA{uint8(x*4) + noise, uint8(y*4) + noise, 128 + noise, 255})
+		}
+	}
+	return i
+}
+
+func TestEncodeJpegBounds(t *testing.T) {
+	i := noisyImage(64, 64)
+
+	sizes := make(map[int]int)
+	for _, quality := range []int{40, 60, 95} {
+		data, err := encodeJpeg(i, quality)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[quality] = len(data)
+	}
+
+	tests := []struct {
+		name     string
+		profile  *ProfileConfig
+		overhead int
+		expected int
+	}{
+		{"fixed quality", &ProfileConfig{Quality: 72, MinQuality: 40, MaxQuality: 95}, 0, 72},
+		{"budget fits everything", &ProfileConfig{MaxBytes: 1 << 20, MinQuality: 40, MaxQuality: 95}, 0, 95},
+		{"budget fits the max exactly", &ProfileConfig{MaxBytes: sizes[95], MinQuality: 40, MaxQuality: 95}, 0, 95},
+		{"budget fits nothing", &ProfileConfig{MaxBytes: 100, MinQuality: 40, MaxQuality: 95}, 0, 40},
+		{"budget fits the min exactly", &ProfileConfig{MaxBytes: sizes[40], MinQuality: 40, MaxQuality: 95}, 0, 40},
+		{"overhead counts", &ProfileConfig{MaxBytes: sizes[40] + 99, MinQuality: 40, MaxQuality: 95}, 100, 40},
+		{"budget in the middle", &ProfileConfig{MaxBytes: sizes[60], MinQuality: 40, MaxQuality: 95}, 0, 60},
+		{"any quality is similar enough", &ProfileConfig{TargetSSIM: 0.01, MinQuality: 40, MaxQuality: 95}, 0, 40},
+		{"unreachable similarity", &ProfileConfig{TargetSSIM: 0.99999, MinQuality: 40, MaxQuality: 90}, 0, 90},
+		{"similarity caps the budget", &ProfileConfig{TargetSSIM: 0.01, MaxBytes: 1 << 20, MinQuality: 40, MaxQuality: 95}, 0, 40},
+		{"budget wins over similarity", &ProfileConfig{TargetSSIM: 0.99999, MaxBytes: sizes[60], MinQuality: 40, MaxQuality: 95}, 0, 60},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, quality, err := test.profile.EncodeJpeg(i, test.overhead)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if quality != test.expected {
+				t.Fatalf("expected quality %d, got %d", test.expected, quality)
+			}
+			expected, err := encodeJpeg(i, quality)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, expected) {
+				t.Fatalf("data isn't the encoding at quality %d", quality)
+			}
+		})
+	}
+}
+
+// The lowest quality reaching the target, the search shouldn't settle
+// above it.
+func TestEncodeJpegSimilarity(t *testing.T) {
+	i := noisyImage(64, 64)
+	reference := lumaPlane(i)
+
+	similarity := func(quality int) float64 {
+		data, err := encodeJpeg(i, quality)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ssim(reference, lumaPlane(decoded))
+	}
+
+	for _, target := range []float64{0.8, 0.9, 0.95} {
+		p := &ProfileConfig{TargetSSIM: target, MinQuality: 40, MaxQuality: 95}
+		_, quality, err := p.EncodeJpeg(i, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quality < p.MinQuality || quality > p.MaxQuality {
+			t.Fatalf("target %v: quality %d out of bounds", target, quality)
+		}
+		if s := similarity(quality); s < target {
+			t.Fatalf("target %v: quality %d only reaches %v", target, quality, s)
+		}
+		if quality > p.MinQuality && similarity(quality-1) >= target {
+			t.Fatalf("target %v: quality %d reaches it too", target, quality-1)
+		}
+	}
+}
+
+func TestSsim(t *testing.T) {
+	i := lumaPlane(noisyImage(32, 32))
+
+	if s := ssim(i, i); s < 0.9999 {
+		t.Fatalf("identical planes should be similar, got %v", s)
+	}
+
+	inverted := &plane{Width: i.Width, Height: i.Height, Pix: make([]float64, len(i.Pix))}
+	for n, v := range i.Pix {
+		inverted.Pix[n] = 255 - v
+	}
+	if s := ssim(i, inverted); s > 0 {
+		t.Fatalf("inverted planes should be dissimilar, got %v", s)
+	}
+
+	tiny := lumaPlane(noisyImage(4, 4))
+	if s := ssim(tiny, tiny); s != 1 {
+		t.Fatalf("planes smaller than a window should compare equal, got %v", s)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// Pixels looked at when building a palette, more than this only
+// slows things down.
+const quantizeSamples = 1 << 16
+
+type colorBox struct {
+	pixels [][3]uint8
+}
+
+// The channel with the widest range, and that range.
+func (b *colorBox) widest() (int, int) {
+	channel, widest := 0, -1
+	for c := 0; c < 3; c++ {
+		low, high := 255, 0
+		for _, p := range b.pixels {
+			low = min(low, int(p[c]))
+			high = max(high, int(p[c]))
+		}
+		if high-low > widest {
+			channel, widest = c, high-low
+		}
+	}
+	return channel, widest
+}
+
+func (b *colorBox) average() color.Color {
+	var sum [3]int
+	for _, p := range b.pixels {
+		for c := 0; c < 3; c++ {
+			sum[c] += int(p[c])
+		}
+	}
+	n := len(b.pixels)
+	return color.RGBA{uint8((sum[0] + n/2) / n), uint8((sum[1] + n/2) / n), uint8((sum[2] + n/2) / n), 0xff}
+}
+
+// Median cut, the box with the most pixels times the widest range is
+// split at its median along that range until there are size boxes,
+// each box gives the palette the average of its pixels.
+func medianCut(i image.Image, size int) color.Palette {
+	bounds := i.Bounds()
+
+	step := 1
+	for bounds.Dx()*bounds.Dy()/(step*step) > quantizeSamples {
+		step++
+	}
+
+	pixels := make([][3]uint8, 0, quantizeSamples)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r, g, b, _ := i.At(x, y).RGBA()
+			pixels = append(pixels, [3]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)})
+		}
+	}
+
+	if len(pixels) == 0 {
+		return color.Palette{color.Black}
+	}
+
+	boxes := []*colorBox{{pixels: pixels}}
+	for len(boxes) < size {
+		split, channel, score := -1, 0, 0
+		for n, b := range boxes {
+			if len(b.pixels) < 2 {
+				continue
+			}
+			c, widest := b.widest()
+			if s := widest * len(b.pixels); widest > 0 && s > score {
+				split, channel, score = n, c, s
+			}
+		}
+		if split < 0 {
+			break
+		}
+
+		b := boxes[split]
+		sort.Slice(b.pixels, func(i, j int) bool {
+			return b.pixels[i][channel] < b.pixels[j][channel]
+		})
+
+		median := len(b.pixels) / 2
+		boxes[split] = &colorBox{pixels: b.pixels[:median]}
+		boxes = append(boxes, &colorBox{pixels: b.pixels[median:]})
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, b := range boxes {
+		palette = append(palette, b.average())
+	}
+
+	return palette
+}
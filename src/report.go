@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+)
+
+// Report collects everything worth knowing about a run that isn't
+// an error, so it can be logged at the end and optionally written out
+// for scripts to look at.
+type Report struct {
+	Stale      []*StaleExport      `json:"stale"`
+	Missing    []*MissingExport    `json:"missing"`
+	Exports    []*ExportRun        `json:"exports"`
+	Exclusions []*Exclusion        `json:"exclusions"`
+	Duplicates []*DuplicateCluster `json:"duplicates"`
+}
+
+type Exclusion struct {
+	Album string `json:"album,omitempty"`
+	Rule  string `json:"rule"`
+	Count int    `json:"count"`
+}
+
+func (r *Report) Exclude(album, rule string) {
+	for _, e := range r.Exclusions {
+		if e.Album == album && e.Rule == rule {
+			e.Count++
+			return
+		}
+	}
+
+	r.Exclusions = append(r.Exclusions, &Exclusion{
+		Album: album,
+		Rule:  rule,
+		Count: 1,
+	})
+}
+
+func (r *Report) Log() {
+	for _, e := range r.Exclusions {
+		if e.Album == "" {
+			log.Printf("excluded %d photos (%s)", e.Count, e.Rule)
+		} else {
+			log.Printf("excluded %d photos from '%s' (%s)", e.Count, e.Album, e.Rule)
+		}
+	}
+
+	for _, d := range r.Duplicates {
+		if d.Kept != "" {
+			log.Printf("near duplicates in '%s': %v (kept %s)", d.Album, d.Files, d.Kept)
+		} else {
+			log.Printf("near duplicates in '%s': %v", d.Album, d.Files)
+		}
+	}
+
+	for _, s := range r.Stale {
+		log.Printf("stale export: %s (%s, edited %v, exported %v)", s.ExportPath, s.Reason, s.EditedAt, s.ExportedAt)
+	}
+
+	for _, m := range r.Missing {
+		log.Printf("missing export: %s (%v)", m.XmpPath, m.Albums)
+	}
+
+	for _, e := range r.Exports {
+		if e.Error != "" {
+			log.Printf("export failed: %s (exit %d) %s", e.RawPath, e.ExitStatus, e.Error)
+		} else {
+			log.Printf("exported: %s -> %s (%v)", e.RawPath, e.Destination, e.Duration)
+		}
+	}
+}
+
+func (r *Report) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReportExclude(t *testing.T) {
+	r := &Report{}
+	r.Exclude("trip", "tag private")
+	r.Exclude("trip", "tag private")
+	r.Exclude("trip", "pattern *.haar.jpg")
+	r.Exclude("", "tag private")
+	r.Exclude("trip", "tag private")
+
+	expected := []*Exclusion{
+		{Album: "trip", Rule: "tag private", Count: 3},
+		{Album: "trip", Rule: "pattern *.haar.jpg", Count: 1},
+		{Rule: "tag private", Count: 1},
+	}
+	if !reflect.DeepEqual(r.Exclusions, expected) {
+		t.Fatalf("expected %v, got %v", expected, r.Exclusions)
+	}
+}
+
+func TestReportWrite(t *testing.T) {
+	r := &Report{
+		Missing: []*MissingExport{{XmpPath: "/library/DSC002.ARW.xmp", RawPath: "/library/DSC002.ARW", Albums: []string{"trip"}}},
+	}
+	r.Exclude("", "tag private")
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := r.Write(path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(map[string]interface{})
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"stale": nil,
+		"missing": []interface{}{map[string]interface{}{
+			"xmp":    "/library/DSC002.ARW.xmp",
+			"raw":    "/library/DSC002.ARW",
+			"albums": []interface{}{"trip"},
+		}},
+		"exports":    nil,
+		"exclusions": []interface{}{map[string]interface{}{"rule": "tag private", "count": 1.0}},
+		"duplicates": nil,
+	}
+	if !reflect.DeepEqual(written, expected) {
+		t.Fatalf("expected %v, got %s", expected, data)
+	}
+}
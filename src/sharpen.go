@@ -0,0 +1,124 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// SharpenConfig is a classic unsharp mask, applied after resizing to
+// bring back some of the crispness downsampling takes away. Radius is
+// the gaussian's standard deviation in pixels, amount how much of the
+// difference is added back and threshold the smallest difference, out
+// of 255, that gets sharpened so smooth areas don't turn to grain.
+type SharpenConfig struct {
+	Radius    float64 `json:"radius"`
+	Amount    float64 `json:"amount"`
+	Threshold uint8   `json:"threshold"`
+}
+
+func gaussianKernel(sigma float64) []float64 {
+	size := int(math.Ceil(sigma * 3))
+	kernel := make([]float64, size*2+1)
+	sum := 0.0
+	for i := range kernel {
+		x := float64(i - size)
+		kernel[i] = math.Exp(-(x * x) / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+// Blurs interleaved 8 bit pixels with a separable gaussian, leaving
+// edges clamped.
+func gaussianBlur(pix []uint8, width, height, stride, channels int, sigma float64) []float64 {
+	kernel := gaussianKernel(sigma)
+	half := len(kernel) / 2
+
+	clamp := func(v, max int) int {
+		if v < 0 {
+			return 0
+		}
+		if v >= max {
+			return max - 1
+		}
+		return v
+	}
+
+	horizontal := make([]float64, width*height*channels)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			for c := 0; c < channels; c++ {
+				sum := 0.0
+				for k, weight := range kernel {
+					sx := clamp(x+k-half, width)
+					sum += weight * float64(pix[y*stride+sx*channels+c])
+				}
+				horizontal[(y*width+x)*channels+c] = sum
+			}
+		}
+	}
+
+	blurred := make([]float64, width*height*channels)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			for c := 0; c < channels; c++ {
+				sum := 0.0
+				for k, weight := range kernel {
+					sy := clamp(y+k-half, height)
+					sum += weight * horizontal[(sy*width+x)*channels+c]
+				}
+				blurred[(y*width+x)*channels+c] = sum
+			}
+		}
+	}
+
+	return blurred
+}
+
+func unsharpMask(i image.Image, s *SharpenConfig) image.Image {
+	bounds := i.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	var pix []uint8
+	var stride, channels, colors int
+	var sharpened image.Image
+
+	// Grayscale stays grayscale, so its color profile still applies.
+	if gray, ok := i.(*image.Gray); ok {
+		copied := image.NewGray(bounds)
+		copy(copied.Pix, gray.Pix)
+		if gray.Stride != copied.Stride {
+			draw.Draw(copied, bounds, gray, bounds.Min, draw.Src)
+		}
+		pix, stride, channels, colors = copied.Pix, copied.Stride, 1, 1
+		sharpened = copied
+	} else {
+		rgba := image.NewRGBA(bounds)
+		draw.Draw(rgba, bounds, i, bounds.Min, draw.Src)
+		pix, stride, channels, colors = rgba.Pix, rgba.Stride, 4, 3
+		sharpened = rgba
+	}
+
+	blurred := gaussianBlur(pix, width, height, stride, channels, s.Radius)
+
+	threshold := float64(s.Threshold)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			for c := 0; c < colors; c++ {
+				offset := y*stride + x*channels + c
+				original := float64(pix[offset])
+				difference := original - blurred[(y*width+x)*channels+c]
+				if math.Abs(difference) < threshold {
+					continue
+				}
+				pix[offset] = uint8(math.Max(0, math.Min(255, math.Round(original+s.Amount*difference))))
+			}
+		}
+	}
+
+	return sharpened
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestGaussianKernel(t *testing.T) {
+	tests := []struct {
+		sigma  float64
+		length int
+	}{
+		{0.5, 5},
+		{1, 7},
+		{1.2, 9},
+		{2, 13},
+	}
+
+	for _, test := range tests {
+		kernel := gaussianKernel(test.sigma)
+		if len(kernel) != test.length {
+			t.Fatalf("sigma %v: expected %d taps, got %d", test.sigma, test.length, len(kernel))
+		}
+
+		sum := 0.0
+		for i, weight := range kernel {
+			sum += weight
+			if weight != kernel[len(kernel)-1-i] {
+				t.Fatalf("sigma %v: kernel isn't symmetric %v", test.sigma, kernel)
+			}
+			if i > 0 && i <= len(kernel)/2 && weight <= kernel[i-1] {
+				t.Fatalf("sigma %v: kernel doesn't peak in the middle %v", test.sigma, kernel)
+			}
+		}
+		if math.Abs(sum-1) > 1e-9 {
+			t.Fatalf("sigma %v: kernel sums to %v", test.sigma, sum)
+		}
+	}
+}
+
+// A vertical edge from dark to light at x = 4.
+func edgeImage(gray bool, dark, light uint8) image.Image {
+	bounds := image.Rect(0, 0, 8, 4)
+	var i interface {
+		image.Image
+		Set(x, y int, c color.Color)
+	}
+	if gray {
+		i = image.NewGray(bounds)
+	} else {
+		i = image.NewRGBA(bounds)
+	}
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 8; x++ {
+			v := dark
+			if x >= 4 {
+				v = light
+			}
+			i.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	return i
+}
+
+func TestUnsharpMask(t *testing.T) {
+	tests := []struct {
+		name      string
+		image     image.Image
+		sharpen   *SharpenConfig
+		dark      uint8
+		light     uint8
+		sharpened bool
+	}{
+		{"flat is unchanged", edgeImage(false, 120, 120), &SharpenConfig{Radius: 1, Amount: 1}, 120, 120, false},
+		{"edge overshoots", edgeImage(false, 100, 150), &SharpenConfig{Radius: 1, Amount: 1}, 100, 150, true},
+		{"gray edge overshoots", edgeImage(true, 100, 150), &SharpenConfig{Radius: 1, Amount: 1}, 100, 150, true},
+		{"below the threshold", edgeImage(false, 100, 150), &SharpenConfig{Radius: 1, Amount: 1, Threshold: 50}, 100, 150, false},
+		{"clamped", edgeImage(false, 0, 255), &SharpenConfig{Radius: 1, Amount: 2}, 0, 255, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := color.GrayModel.Convert(test.image.At(3, 1)).(color.Gray).Y
+
+			sharpened := unsharpMask(test.image, test.sharpen)
+
+			_, gray := test.image.(*image.Gray)
+			if _, ok := sharpened.(*image.Gray); ok != gray {
+				t.Fatalf("expected gray %v, got %T", gray, sharpened)
+			}
+			if after := color.GrayModel.Convert(test.image.At(3, 1)).(color.Gray).Y; after != before {
+				t.Fatalf("the original was modified")
+			}
+
+			r, g, b, a := sharpened.At(3, 1).RGBA()
+			if r != g || g != b || a != 0xffff {
+				t.Fatalf("expected opaque gray, got %v", sharpened.At(3, 1))
+			}
+
+			for y := 0; y < 4; y++ {
+				left := color.GrayModel.Convert(sharpened.At(3, y)).(color.Gray).Y
+				right := color.GrayModel.Convert(sharpened.At(4, y)).(color.Gray).Y
+				far := color.GrayModel.Convert(sharpened.At(0, y)).(color.Gray).Y
+
+				if far != test.dark {
+					t.Fatalf("away from the edge expected %d, got %d", test.dark, far)
+				}
+				if test.sharpened != (left < test.dark && right > test.light) {
+					t.Fatalf("expected sharpened %v, got %d %d around %d %d", test.sharpened, left, right, test.dark, test.light)
+				}
+				if !test.sharpened && (left != test.dark || right != test.light) {
+					t.Fatalf("expected %d %d, got %d %d", test.dark, test.light, left, right)
+				}
+			}
+		})
+	}
+}
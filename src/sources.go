@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "image/png"
+
+	_ "golang.org/x/image/tiff"
+)
+
+// SourceConfig is a directory of exported images. In the configuration
+// a source can be just a path, which gets the defaults, or an object.
+type SourceConfig struct {
+	Path           string   `json:"path"`
+	Include        []string `json:"include"`
+	Exclude        []string `json:"exclude"`
+	FollowSymlinks bool     `json:"follow_symlinks"`
+	MaxDepth       int      `json:"max_depth"`
+	Formats        []string `json:"formats"`
+}
+
+var (
+	// Intermediate files from face detection experiments that were
+	// written next to the exports.
+	DefaultSourceExclude = []string{"*.haar.jpg", "*.cnn.jpg"}
+	DefaultSourceFormats = []string{"jpeg"}
+)
+
+var formatExtensions = map[string][]string{
+	"jpeg": {".jpg", ".jpeg"},
+	"png":  {".png"},
+	"tiff": {".tif", ".tiff"},
+}
+
+func (sc *SourceConfig) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*sc = SourceConfig{Path: path}
+		return nil
+	}
+
+	type plain SourceConfig
+	return json.Unmarshal(data, (*plain)(sc))
+}
+
+type sourceWalker struct {
+	Source     *SourceConfig
+	Extensions map[string]bool
+	Exclude    []string
+	Visited    map[string]bool
+	Include    func(path string) error
+}
+
+// Walks a source, calling include for every image it accepts.
+func (sc *SourceConfig) Walk(include func(path string) error) error {
+	w := &sourceWalker{
+		Source:     sc,
+		Extensions: make(map[string]bool),
+		Exclude:    sc.Exclude,
+		Visited:    make(map[string]bool),
+		Include:    include,
+	}
+
+	// Only a missing exclude gets the default, an empty one clears it.
+	if w.Exclude == nil {
+		w.Exclude = DefaultSourceExclude
+	}
+
+	formats := sc.Formats
+	if len(formats) == 0 {
+		formats = DefaultSourceFormats
+	}
+
+	for _, format := range formats {
+		extensions, ok := formatExtensions[strings.ToLower(format)]
+		if !ok {
+			return fmt.Errorf("%s: unknown format '%s'", sc.Path, format)
+		}
+		for _, extension := range extensions {
+			w.Extensions[extension] = true
+		}
+	}
+
+	for _, pattern := range append(append([]string{}, sc.Include...), w.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s: bad pattern '%s'", sc.Path, pattern)
+		}
+	}
+
+	return w.walk(sc.Path, 0)
+}
+
+// Patterns with a separator are matched against the path relative to
+// the source, everything else against the file name.
+func (w *sourceWalker) matches(patterns []string, path string) bool {
+	relative, err := filepath.Rel(w.Source.Path, path)
+	if err != nil {
+		relative = path
+	}
+
+	for _, pattern := range patterns {
+		candidate := filepath.Base(path)
+		if strings.Contains(pattern, "/") {
+			candidate = filepath.ToSlash(relative)
+		}
+		if matched, _ := filepath.Match(pattern, candidate); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w *sourceWalker) walk(directory string, depth int) error {
+	if real, err := filepath.EvalSymlinks(directory); err == nil {
+		if w.Visited[real] {
+			return nil
+		}
+		w.Visited[real] = true
+	}
+
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range entries {
+		path := filepath.Join(directory, info.Name())
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !w.Source.FollowSymlinks {
+				continue
+			}
+
+			info, err = os.Stat(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		if w.matches(w.Exclude, path) {
+			continue
+		}
+
+		if info.IsDir() {
+			if w.Source.MaxDepth == 0 || depth+1 < w.Source.MaxDepth {
+				if err := w.walk(path, depth+1); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		if !w.Extensions[strings.ToLower(filepath.Ext(info.Name()))] {
+			continue
+		}
+
+		if len(w.Source.Include) > 0 && !w.matches(w.Source.Include, path) {
+			continue
+		}
+
+		if err := w.Include(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Derivatives are always JPEG, so sources in other formats get a new
+// extension. Extensions are matched ignoring case.
+func derivativeName(original string) string {
+	name := filepath.Base(original)
+	extension := filepath.Ext(name)
+	for _, e := range formatExtensions["jpeg"] {
+		if strings.ToLower(extension) == e {
+			return name
+		}
+	}
+	return strings.TrimSuffix(name, extension) + ".jpg"
+}
+
+// Derivatives are named after their source, IMG.png and IMG.jpg would
+// overwrite each other's.
+func (c *Cache) ClaimName(name, source string) error {
+	if other, ok := c.SourcesByName[name]; ok && other != source {
+		return fmt.Errorf("%s and %s would both be published as %s", other, source, name)
+	}
+	c.SourcesByName[name] = source
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDerivativeName(t *testing.T) {
+	tests := []struct {
+		original string
+		expected string
+	}{
+		{"/exports/IMG_0001.jpg", "IMG_0001.jpg"},
+		{"/exports/IMG_0001.jpeg", "IMG_0001.jpeg"},
+		{"/exports/IMG_0001.JPG", "IMG_0001.JPG"},
+		{"/exports/IMG_0001.png", "IMG_0001.jpg"},
+		{"/exports/IMG_0001.tiff", "IMG_0001.jpg"},
+	}
+
+	for _, test := range tests {
+		if actual := derivativeName(test.original); actual != test.expected {
+			t.Fatalf("%s: expected %s, got %s", test.original, test.expected, actual)
+		}
+	}
+}
+
+func TestSourceWalkFormats(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.jpg", "b.jpeg", "c.JPG", "d.JPEG", "e.png", "f.TIF"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		formats  []string
+		expected []string
+	}{
+		{nil, []string{"a.jpg", "b.jpeg", "c.JPG", "d.JPEG"}},
+		{[]string{"png", "tiff"}, []string{"e.png", "f.TIF"}},
+	}
+
+	for _, test := range tests {
+		found := make([]string, 0)
+		sc := &SourceConfig{Path: dir, Formats: test.formats}
+		err := sc.Walk(func(path string) error {
+			found = append(found, filepath.Base(path))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(found)
+		if !reflect.DeepEqual(found, test.expected) {
+			t.Fatalf("%v: expected %v, got %v", test.formats, test.expected, found)
+		}
+	}
+}
+
+func TestClaimName(t *testing.T) {
+	c := &Cache{SourcesByName: make(map[string]string)}
+
+	if err := c.ClaimName("IMG.jpg", "/exports/IMG.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ClaimName("IMG.jpg", "/exports/IMG.jpg"); err != nil {
+		t.Fatalf("including a source again should be fine: %v", err)
+	}
+	if err := c.ClaimName("IMG.jpg", "/exports/IMG.png"); err == nil {
+		t.Fatalf("expected IMG.png to collide with IMG.jpg")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type StaleConfig struct {
+	Fail bool `json:"fail"`
+}
+
+type StaleExport struct {
+	ExportPath string    `json:"export"`
+	XmpPath    string    `json:"xmp"`
+	Reason     string    `json:"reason"`
+	EditedAt   time.Time `json:"edited_at"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+type MissingExport struct {
+	XmpPath string   `json:"xmp"`
+	RawPath string   `json:"raw"`
+	Albums  []string `json:"albums"`
+}
+
+func (r *Report) HasStaleExports() bool {
+	return len(r.Stale) > 0 || len(r.Missing) > 0
+}
+
+// Seconds between 0001-01-01 and the unix epoch.
+const darktableEpochOffset = 62135596800
+
+// Newer versions of darktable write their timestamps as microseconds
+// since 0001-01-01, older ones wrote unix seconds. Zero and negative
+// values mean the timestamp was never set.
+func parseDarktableTimestamp(value string) (time.Time, bool) {
+	v, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || v <= 0 {
+		return time.Time{}, false
+	}
+
+	if v > 1e13 {
+		return time.Unix(v/1e6-darktableEpochOffset, (v%1e6)*1e3), true
+	}
+
+	return time.Unix(v, 0), true
+}
+
+// Compares the time of the last edit against the exported image. We
+// prefer darktable's own change timestamp because the sidecar is also
+// rewritten for changes that don't affect the pixels, like tagging.
+func (g *Generator) CheckStale(exportPath, xmpPath string, xmp *XmpFile) error {
+	exportInfo, err := os.Stat(exportPath)
+	if err != nil {
+		return err
+	}
+
+	stale := &StaleExport{
+		ExportPath: exportPath,
+		XmpPath:    xmpPath,
+		ExportedAt: exportInfo.ModTime(),
+	}
+
+	if changed, ok := parseDarktableTimestamp(xmp.Rdf.Description.ChangeTimestamp); ok {
+		stale.Reason = "history"
+		stale.EditedAt = changed
+	} else {
+		if len(xmp.Rdf.Description.History) == 0 {
+			return nil
+		}
+
+		xmpInfo, err := os.Stat(xmpPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		stale.Reason = "mtime"
+		stale.EditedAt = xmpInfo.ModTime()
+	}
+
+	if stale.EditedAt.After(stale.ExportedAt) {
+		g.Report.Stale = append(g.Report.Stale, stale)
+	}
+
+	return nil
+}
+
+// Finds side car files that would land in an album if only they'd
+// been exported.
+func (g *Generator) FindMissing() ([]*MissingExport, error) {
+	bases := make([]string, 0)
+	for base := range g.Cache.XmpsByBaseName {
+		if _, ok := g.Cache.ExportsByBaseName[base]; !ok {
+			bases = append(bases, base)
+		}
+	}
+
+	sort.Strings(bases)
+
+	missing := make([]*MissingExport, 0)
+
+	for _, base := range bases {
+		xmp, xmpPath, err := g.Cache.FindMetadata(base)
+		if err != nil {
+			return nil, err
+		}
+		if xmp == nil {
+			continue
+		}
+
+		if g.ExcludedByTag(xmp) != "" {
+			continue
+		}
+
+		matches, err := g.MatchAlbums(xmpPath, xmp)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(matches) == 0 {
+			continue
+		}
+
+		m := &MissingExport{
+			XmpPath: xmpPath,
+			RawPath: strings.TrimSuffix(xmpPath, ".xmp"),
+			Albums:  make([]string, 0),
+		}
+
+		for _, match := range matches {
+			m.Albums = append(m.Albums, match.Album.Config.PathName)
+		}
+
+		missing = append(missing, m)
+	}
+
+	return missing, nil
+}
+
+func (g *Generator) CheckMissing() error {
+	missing, err := g.FindMissing()
+	if err != nil {
+		return err
+	}
+
+	g.Report.Missing = append(g.Report.Missing, missing...)
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDarktableTimestamp(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Time
+		ok       bool
+	}{
+		{"", time.Time{}, false},
+		{"0", time.Time{}, false},
+		{"-1", time.Time{}, false},
+		{"soon", time.Time{}, false},
+		{"1626256830", time.Unix(1626256830, 0), true},
+		{" 1626256830 ", time.Unix(1626256830, 0), true},
+		// Microseconds since 0001-01-01, darktable 4 and later.
+		{"63761853630250000", time.Date(2021, 7, 14, 10, 0, 30, 250000000, time.UTC), true},
+	}
+
+	for _, test := range tests {
+		actual, ok := parseDarktableTimestamp(test.value)
+		if ok != test.ok || !actual.Equal(test.expected) {
+			t.Fatalf("%q: expected %v %v, got %v %v", test.value, test.expected, test.ok, actual, ok)
+		}
+	}
+}
+
+func TestCheckStale(t *testing.T) {
+	dir := t.TempDir()
+	exported := time.Date(2021, 7, 14, 12, 0, 0, 0, time.UTC)
+
+	exportPath := filepath.Join(dir, "DSC001.jpg")
+	xmpPath := filepath.Join(dir, "DSC001.ARW.xmp")
+	for _, path := range []string{exportPath, xmpPath} {
+		if err := ioutil.WriteFile(path, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(exportPath, exported, exported); err != nil {
+		t.Fatal(err)
+	}
+
+	edited := []DarkTableHistory{{Operation: "exposure"}}
+
+	tests := []struct {
+		name    string
+		changed string
+		history []DarkTableHistory
+		xmpTime time.Time
+		xmpPath string
+		reason  string
+	}{
+		{"changed after the export", "1626271200", nil, exported, xmpPath, "history"},
+		{"changed before the export", "1626256800", edited, exported.Add(time.Hour), xmpPath, ""},
+		{"sidecar rewritten after the export", "", edited, exported.Add(time.Hour), xmpPath, "mtime"},
+		{"sidecar older than the export", "", edited, exported.Add(-time.Hour), xmpPath, ""},
+		{"never edited", "", nil, exported.Add(time.Hour), xmpPath, ""},
+		{"no sidecar", "", edited, exported.Add(time.Hour), filepath.Join(dir, "missing.xmp"), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := os.Chtimes(xmpPath, test.xmpTime, test.xmpTime); err != nil {
+				t.Fatal(err)
+			}
+
+			xmp := &XmpFile{}
+			xmp.Rdf.Description.ChangeTimestamp = test.changed
+			xmp.Rdf.Description.History = test.history
+
+			g := &Generator{Report: &Report{}}
+			if err := g.CheckStale(exportPath, test.xmpPath, xmp); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.reason == "" {
+				if len(g.Report.Stale) != 0 {
+					t.Fatalf("unexpected stale export %+v", g.Report.Stale[0])
+				}
+				return
+			}
+			if len(g.Report.Stale) != 1 || g.Report.Stale[0].Reason != test.reason {
+				t.Fatalf("expected a stale export because of %s, got %+v", test.reason, g.Report.Stale)
+			}
+			if !g.Report.Stale[0].ExportedAt.Equal(exported) {
+				t.Fatalf("unexpected export time %v", g.Report.Stale[0].ExportedAt)
+			}
+		})
+	}
+}
+
+func TestFindMissing(t *testing.T) {
+	record := func(tags ...string) *XmpFile {
+		xmp := &XmpFile{}
+		xmp.Rdf.Description.HierarchicalSubjects.Subjects = tags
+		return xmp
+	}
+
+	g := &Generator{
+		Config: &Configuration{ExcludeTags: []string{"private"}},
+		Cache: &Cache{
+			MetadataSource: MetadataSourceDatabase,
+			XmpsByBaseName: map[string]string{
+				"DSC001": "/library/DSC001.ARW.xmp",
+				"DSC002": "/library/DSC002.ARW.xmp",
+				"DSC003": "/library/DSC003.ARW.xmp",
+				"DSC004": "/library/DSC004.ARW.xmp",
+				"DSC005": "/library/DSC005.ARW.xmp",
+			},
+			RecordsByBaseName: map[string]*XmpFile{
+				"DSC001": record("trip"),
+				"DSC002": record("trip", "people"),
+				"DSC003": record("trip", "private|family"),
+				"DSC004": record("work"),
+				"DSC005": record("trip"),
+			},
+			ExportsByBaseName: map[string]string{"DSC001": "/exports/DSC001.jpg"},
+			AllAlbums: []*Album{
+				{Config: &AlbumConfig{PathName: "trip", Tags: []string{"trip"}}},
+				{Config: &AlbumConfig{PathName: "people", Tags: []string{"trip", "people"}}},
+			},
+		},
+	}
+
+	missing, err := g.FindMissing()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*MissingExport{
+		{XmpPath: "/library/DSC002.ARW.xmp", RawPath: "/library/DSC002.ARW", Albums: []string{"trip", "people"}},
+		{XmpPath: "/library/DSC005.ARW.xmp", RawPath: "/library/DSC005.ARW", Albums: []string{"trip"}},
+	}
+	if !reflect.DeepEqual(missing, expected) {
+		for _, m := range missing {
+			t.Logf("%+v", m)
+		}
+		t.Fatalf("expected %d missing exports, got %d", len(expected), len(missing))
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// TeaserConfig turns on a small animated GIF per album that cycles
+// through its best photos. Delay is in hundredths of a second.
+type TeaserConfig struct {
+	Photos int  `json:"photos"`
+	Delay  int  `json:"delay"`
+	Width  uint `json:"width"`
+	Height uint `json:"height"`
+}
+
+const (
+	DefaultTeaserPhotos = 5
+	DefaultTeaserDelay  = 150
+	DefaultTeaserWidth  = 480
+	DefaultTeaserHeight = 320
+)
+
+func (c *TeaserConfig) withDefaults() *TeaserConfig {
+	filled := *c
+	if filled.Photos <= 0 {
+		filled.Photos = DefaultTeaserPhotos
+	}
+	if filled.Delay <= 0 {
+		filled.Delay = DefaultTeaserDelay
+	}
+	// Either side alone keeps the default shape.
+	switch {
+	case filled.Width == 0 && filled.Height == 0:
+		filled.Width, filled.Height = DefaultTeaserWidth, DefaultTeaserHeight
+	case filled.Height == 0:
+		filled.Height = max(1, (filled.Width*DefaultTeaserHeight+DefaultTeaserWidth/2)/DefaultTeaserWidth)
+	case filled.Width == 0:
+		filled.Width = max(1, (filled.Height*DefaultTeaserWidth+DefaultTeaserHeight/2)/DefaultTeaserHeight)
+	}
+	return &filled
+}
+
+// Makes the album's teaser next to its gallery json. Every frame is
+// filled the way cropped derivatives are and gets its own palette.
+func (g *Generator) Teaser(album *Album) error {
+	album.Teaser = nil
+
+	cfg := g.Config.Teaser.withDefaults()
+
+	files := bestPhotos(album, cfg.Photos)
+	if len(files) == 0 {
+		return nil
+	}
+
+	path := filepath.Join(g.AlbumsRoot, fmt.Sprintf("%s.teaser.gif", album.Config.PathName))
+
+	source, settings, err := g.compositeSettings(files, cfg)
+	if err != nil {
+		return err
+	}
+
+	meta := &ImageMeta{Path: path, Dx: cfg.Width, Dy: cfg.Height, Policy: FitFill}
+
+	if g.Manifest.Current(path, source, settings) {
+		album.Teaser = meta
+		return nil
+	}
+
+	log.Printf("teaser '%s' (%d photos)", album.Config.Title, len(files))
+
+	resizer := (&ProfileConfig{Filter: DefaultResamplingFilter}).Resizer()
+	animation := &gif.GIF{}
+
+	for _, af := range files {
+		original, err := g.Cache.Load(af.OriginalPath)
+		if err != nil {
+			return err
+		}
+
+		crop, err := g.FillCrop(af.OriginalPath, original, int(cfg.Width), int(cfg.Height))
+		if err != nil {
+			return err
+		}
+
+		resized := resizer.Resize(original.(SubImager).SubImage(crop), cfg.Width, cfg.Height)
+
+		// GIFs don't carry profiles, the frames have to be sRGB.
+		converted, _, _ := manageColor(resized, g.Cache.Images.Profile, ColorConvert)
+
+		frame := image.NewPaletted(image.Rect(0, 0, int(cfg.Width), int(cfg.Height)), medianCut(converted, 256))
+		draw.FloydSteinberg.Draw(frame, frame.Bounds(), converted, converted.Bounds().Min)
+
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, cfg.Delay)
+	}
+
+	buffer := &bytes.Buffer{}
+	err = gif.EncodeAll(buffer, animation)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path, buffer.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+
+	g.Manifest.Record(path, &DerivativeRecord{
+		Source:   source,
+		Profile:  "teaser",
+		Settings: settings,
+		Bytes:    buffer.Len(),
+	})
+
+	album.Teaser = meta
+
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTeaserDimensions(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height uint
+		expected      [2]uint
+	}{
+		{"defaults", 0, 0, [2]uint{480, 320}},
+		{"both given", 300, 300, [2]uint{300, 300}},
+		{"width only", 600, 0, [2]uint{600, 400}},
+		{"height only", 0, 200, [2]uint{300, 200}},
+		{"width only rounds", 100, 0, [2]uint{100, 67}},
+		{"tiny width", 1, 0, [2]uint{1, 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filled := (&TeaserConfig{Width: test.width, Height: test.height}).withDefaults()
+			if filled.Width != test.expected[0] || filled.Height != test.expected[1] {
+				t.Fatalf("expected %v, got [%d %d]", test.expected, filled.Width, filled.Height)
+			}
+		})
+	}
+}